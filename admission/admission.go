@@ -3,131 +3,732 @@ package admission
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/wI2L/jsondiff"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	jsonserializer "k8s.io/apimachinery/pkg/runtime/serializer/json"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	cloudprovider "k8s.io/cloud-provider"
 	volumehelpers "k8s.io/cloud-provider/volume/helpers"
 	storagehelpers "k8s.io/component-helpers/storage/volume"
 	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/cloud-pv-admission-labeler/auditlog"
+	"sigs.k8s.io/cloud-pv-admission-labeler/labeler"
+	"sigs.k8s.io/cloud-pv-admission-labeler/metrics"
+)
+
+const (
+	// ExternalProvider is the name under which an external labeler is configured.
+	ExternalProvider = "external"
+	// StaticProvider is the name under which a labeler resolving labels from
+	// a mapping file instead of a cloud provider is configured.
+	StaticProvider = "static"
+	// InferenceProvider is the name under which a labeler inferring labels
+	// from volume identifiers and StorageClasses is configured.
+	InferenceProvider = "inference"
+)
+
+// tracerName is the instrumentation name of the spans of PVLabelAdmission.
+const tracerName = "sigs.k8s.io/cloud-pv-admission-labeler/admission"
+
+// volumeTypeUnknown is the volume type recorded before the PV has been decoded.
+const volumeTypeUnknown = "unknown"
+
+// AnnPendingLabels is set on PVs admitted without labels because the cloud
+// provider could not be queried. Its value is the time of the failed lookup.
+const AnnPendingLabels = "cloud-pv-labeler/pending"
+
+// AnnLabelSource is set on PVs labeled through a chain of label sources or the
+// inference labeler to the name of the source or rule that supplied their
+// labels.
+const AnnLabelSource = "cloud-pv-labeler/label-source"
+
+// FailurePolicy defines how PVs are handled when their labels cannot be
+// retrieved from the cloud provider.
+type FailurePolicy string
+
+const (
+	// FailurePolicyFail denies the PV.
+	FailurePolicyFail FailurePolicy = "fail"
+	// FailurePolicyOpen admits the PV without labels, annotated with AnnPendingLabels.
+	FailurePolicyOpen FailurePolicy = "open"
 )
 
+// Options configures the behavior of PVLabelAdmission.
+type Options struct {
+	// FailurePolicy defines how PVs are handled when the cloud provider lookup
+	// fails. Defaults to FailurePolicyFail.
+	FailurePolicy FailurePolicy
+
+	// CloudRequestTimeout bounds how long the cloud provider is queried for
+	// the labels of a volume. It should be set below the webhook's
+	// timeoutSeconds so that a response can be returned before the API server
+	// gives up on the request. Zero means no timeout besides the request's own.
+	CloudRequestTimeout time.Duration
+
+	// NodeAffinityStrategy defines how the node affinity generated from the
+	// cloud labels is merged with the PV's node affinity on the same keys.
+	// Defaults to NodeAffinityStrategySkip.
+	NodeAffinityStrategy NodeAffinityStrategy
+
+	// LabelPolicy defines which of the GA and beta topology labels are set.
+	// Defaults to LabelPolicyAsIs.
+	LabelPolicy LabelPolicy
+
+	// StripBetaLabels removes the deprecated beta topology labels from PVs
+	// when the LabelPolicy does not set them.
+	StripBetaLabels bool
+
+	// LabelSources replaces the PVLabelers of the given cloud providers when
+	// PVs are labeled, e.g. with a labeler.Chain falling back to other label
+	// sources. Validation and CloudLabels always query the PVLabelers.
+	LabelSources map[string]cloudprovider.PVLabeler
+
+	// AuditLog records every mutating admission request if set.
+	AuditLog *auditlog.Logger
+
+	// TracerProvider creates the tracer of the admission request spans.
+	// Defaults to the global TracerProvider.
+	TracerProvider trace.TracerProvider
+
+	// EventRecorder records events on PVs for labeling failures, node affinity
+	// conflicts, denials and fallbacks if set. No events are recorded for
+	// dry-run requests.
+	EventRecorder record.EventRecorder
+}
+
 type PVLabelAdmission struct {
 	scheme *runtime.Scheme
 
+	// cloudProvider names the configured cloud providers where the PV being
+	// handled is not known.
 	cloudProvider string
-	pvLabeler     cloudprovider.PVLabeler
+	pvLabelers    map[string]cloudprovider.PVLabeler
+	options       Options
+	tracer        trace.Tracer
 }
 
-func NewPVLabelAdmission(cloudProvider string, scheme *runtime.Scheme, pvLabeler cloudprovider.PVLabeler) *PVLabelAdmission {
+func NewPVLabelAdmission(cloudProvider string, scheme *runtime.Scheme, pvLabeler cloudprovider.PVLabeler, options Options) *PVLabelAdmission {
+	return NewMultiProviderPVLabelAdmission(scheme, map[string]cloudprovider.PVLabeler{cloudProvider: pvLabeler}, options)
+}
+
+// NewMultiProviderPVLabelAdmission returns a PVLabelAdmission sending every PV
+// to the PVLabeler of the cloud provider its volume source belongs to. The
+// PVLabelers are indexed by cloud provider name: "gce", "aws", "azure",
+// "vsphere", StaticProvider, which receives the PVs of these cloud providers
+// when they are not configured, or ExternalProvider, which receives the PVs of
+// all the other volume sources. Without them, these PVs are admitted without
+// labels.
+func NewMultiProviderPVLabelAdmission(scheme *runtime.Scheme, pvLabelers map[string]cloudprovider.PVLabeler, options Options) *PVLabelAdmission {
+	providers := make([]string, 0, len(pvLabelers))
+	labelers := make(map[string]cloudprovider.PVLabeler, len(pvLabelers))
+	for provider, pvLabeler := range pvLabelers {
+		providers = append(providers, provider)
+		labelers[provider] = pvLabeler
+	}
+	sort.Strings(providers)
+
+	tracerProvider := options.TracerProvider
+	if tracerProvider == nil {
+		tracerProvider = otel.GetTracerProvider()
+	}
+
 	return &PVLabelAdmission{
-		cloudProvider: cloudProvider,
+		cloudProvider: strings.Join(providers, ","),
 		scheme:        scheme,
-		pvLabeler:     pvLabeler,
+		pvLabelers:    labelers,
+		options:       options,
+		tracer:        tracerProvider.Tracer(tracerName),
 	}
 }
 
 func (p *PVLabelAdmission) Admit(w http.ResponseWriter, r *http.Request) {
+	p.serve(w, r, "PVLabelAdmission.Admit", p.review)
+}
+
+// Validate denies PVs whose topology labels or required node affinity
+// contradict the location of their volume reported by the cloud provider.
+func (p *PVLabelAdmission) Validate(w http.ResponseWriter, r *http.Request) {
+	p.serve(w, r, "PVLabelAdmission.Validate", p.validate)
+}
+
+// serve decodes the AdmissionReview of the request, passes it to handle and
+// writes the response. The request is traced in a span with the given name.
+// The context passed to handle is marked with labeler.WithDryRun for dry-run
+// requests.
+func (p *PVLabelAdmission) serve(w http.ResponseWriter, r *http.Request, spanName string, handle func(context.Context, *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse) {
 	defer r.Body.Close()
 
+	ctx, span := p.tracer.Start(r.Context(), spanName)
+	defer span.End()
+
+	start := time.Now()
+	_, decodeSpan := p.tracer.Start(ctx, "decode")
 	data, err := io.ReadAll(r.Body)
 	if err != nil {
+		endSpan(decodeSpan, err)
 		klog.ErrorS(err, "failed to read request body")
-		w.WriteHeader(http.StatusBadRequest)
+		metrics.RecordAdmission(p.cloudProvider, volumeTypeUnknown, metrics.OutcomeError, "read_error", time.Since(start))
+		p.writeResponse(w, denied("", http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("failed to read request body: %v", err)))
 		return
 	}
 
 	codec := jsonserializer.NewSerializerWithOptions(jsonserializer.DefaultMetaFactory, p.scheme, p.scheme, jsonserializer.SerializerOptions{})
 	obj, _, err := codec.Decode(data, nil, nil)
 	if err != nil {
+		endSpan(decodeSpan, err)
 		klog.ErrorS(err, "failed to decode request body")
-		w.WriteHeader(http.StatusBadRequest)
+		metrics.RecordAdmission(p.cloudProvider, volumeTypeUnknown, metrics.OutcomeError, "decode_error", time.Since(start))
+		p.writeResponse(w, denied("", http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("failed to decode request body: %v", err)))
 		return
 	}
 
 	admissionReview, ok := obj.(*admissionv1.AdmissionReview)
-	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
+	if !ok || admissionReview.Request == nil {
+		err := fmt.Errorf("expected an admission.k8s.io/v1 AdmissionReview request, got %s", obj.GetObjectKind().GroupVersionKind())
+		endSpan(decodeSpan, err)
+		klog.ErrorS(err, "failed to decode request body")
+		metrics.RecordAdmission(p.cloudProvider, volumeTypeUnknown, metrics.OutcomeError, "decode_error", time.Since(start))
+		p.writeResponse(w, denied("", http.StatusBadRequest, metav1.StatusReasonBadRequest, err.Error()))
 		return
 	}
 
-	if admissionReview.Request.Kind.Kind != "PersistentVolume" {
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	endSpan(decodeSpan, nil)
+
+	request := admissionReview.Request
+	span.SetAttributes(
+		attribute.String("admission.uid", string(request.UID)),
+		attribute.String("admission.operation", string(request.Operation)),
+		attribute.String("admission.name", request.Name),
+	)
+	if request.DryRun != nil && *request.DryRun {
+		// The webhooks declare sideEffects: NoneOnDryRun, the response is
+		// computed the same way but nothing else may be changed.
+		ctx = labeler.WithDryRun(ctx)
+		span.SetAttributes(attribute.Bool("admission.dry_run", true))
+	}
+
+	response := handle(ctx, request)
+	span.SetAttributes(attribute.Bool("admission.allowed", response.Allowed))
+	p.writeResponse(w, response)
+}
+
+// review handles a decoded admission request and returns the response to it.
+func (p *PVLabelAdmission) review(ctx context.Context, request *admissionv1.AdmissionRequest) (response *admissionv1.AdmissionResponse) {
+	start := time.Now()
+	volumeType := volumeTypeUnknown
+	provider := p.cloudProvider
+	outcome, reason := metrics.OutcomeError, "internal_error"
+	record := &auditlog.Record{PV: request.Name}
+	defer func() {
+		metrics.RecordAdmission(provider, volumeType, outcome, reason, time.Since(start))
+		record.Provider, record.VolumeType, record.Outcome, record.Reason = provider, volumeType, outcome, reason
+		p.audit(request, record, response, start)
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.String("pv.provider", provider),
+			attribute.String("pv.volume_type", volumeType),
+			attribute.String("admission.outcome", outcome),
+			attribute.String("admission.reason", reason),
+		)
+	}()
+
+	if request.Kind.Kind != "PersistentVolume" {
+		err := fmt.Errorf("unsupported kind %s, only PersistentVolumes are handled", request.Kind.Kind)
+		klog.ErrorS(err, "failed to handle admission request", "uid", request.UID, "name", request.Name)
+		reason = "unsupported_kind"
+		return denied(request.UID, http.StatusBadRequest, metav1.StatusReasonBadRequest, err.Error())
 	}
 
 	pv := &corev1.PersistentVolume{}
-	if err := json.Unmarshal(admissionReview.Request.Object.Raw, pv); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	if err := json.Unmarshal(request.Object.Raw, pv); err != nil {
+		klog.ErrorS(err, "failed to decode PersistentVolume", "uid", request.UID, "pv", request.Name)
+		reason = "decode_error"
+		return denied(request.UID, http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("failed to decode PersistentVolume: %v", err))
+	}
+	volumeType = getVolumeType(pv)
+	provider = p.providerName(pv)
+	record.PV, record.Volume = pv.Name, getVolumeID(pv)
+
+	allowed := &admissionv1.AdmissionResponse{
+		UID:     request.UID,
+		Allowed: true,
+	}
+	if !p.CanLabel(pv) {
+		outcome, reason = metrics.OutcomeSkipped, "unsupported_volume"
+		return allowed
+	}
+
+	var oldPV *corev1.PersistentVolume
+	if request.Operation == admissionv1.Update {
+		oldPV = &corev1.PersistentVolume{}
+		if err := json.Unmarshal(request.OldObject.Raw, oldPV); err != nil {
+			klog.ErrorS(err, "failed to decode old PersistentVolume", "uid", request.UID, "pv", request.Name)
+			reason = "decode_error"
+			return denied(request.UID, http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("failed to decode old PersistentVolume: %v", err))
+		}
+		if pv.DeletionTimestamp != nil {
+			outcome, reason = metrics.OutcomeSkipped, "deleting"
+			return allowed
+		}
 	}
 
-	if pv.Spec.GCEPersistentDisk == nil && pv.Spec.AzureDisk == nil &&
-		pv.Spec.AWSElasticBlockStore == nil && pv.Spec.VsphereVolume == nil {
-		resp := &admissionv1.AdmissionReview{
-			TypeMeta: metav1.TypeMeta{
-				Kind:       "AdmissionReview",
-				APIVersion: "admission.k8s.io/v1",
-			},
-			Response: &admissionv1.AdmissionResponse{
-				UID:     admissionReview.Request.UID,
-				Allowed: true,
-			},
+	volumeLabels, preserved := p.preservedVolumeLabels(oldPV, pv)
+	var source string
+	if !preserved {
+		if p.options.CloudRequestTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, p.options.CloudRequestTimeout)
+			defer cancel()
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		outBytes, err := json.Marshal(resp)
+		var err error
+		volumeLabels, source, err = p.getVolumeLabels(ctx, pv)
+		if err != nil && oldPV != nil {
+			// Never block updates of existing PVs, e.g. removing the
+			// finalizers of a PV whose volume was deleted from the cloud.
+			klog.ErrorS(err, "failed to get volume labels, admitting PersistentVolume update without labels", "uid", request.UID, "pv", klog.KObj(pv))
+			outcome, reason = metrics.OutcomeSkipped, "cloud_error"
+			allowed.Warnings = []string{fmt.Sprintf("PersistentVolume %s not labeled: error getting labels from cloud provider %s: %v", pv.Name, provider, err)}
+			p.event(ctx, pv, corev1.EventTypeWarning, EventReasonLabelingFailed, "Update admitted without labels: error getting labels from cloud provider %s: %v", provider, err)
+			return allowed
+		}
+		if err != nil && p.options.FailurePolicy == FailurePolicyOpen {
+			klog.ErrorS(err, "failed to get volume labels, admitting PersistentVolume without labels", "uid", request.UID, "pv", klog.KObj(pv))
+			outcome, reason = metrics.OutcomePending, "cloud_error"
+			if errors.Is(err, context.DeadlineExceeded) {
+				reason = "cloud_timeout"
+			}
+			p.event(ctx, pv, corev1.EventTypeWarning, EventReasonLabelsPending, "Admitted without labels, to be labeled later: error getting labels from cloud provider %s: %v", provider, err)
+			return p.admitPending(request.UID, pv, err)
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			klog.ErrorS(err, "timed out getting volume labels", "uid", request.UID, "pv", klog.KObj(pv))
+			outcome, reason = metrics.OutcomeRejected, "cloud_timeout"
+			p.event(ctx, pv, corev1.EventTypeWarning, EventReasonLabelingFailed, "Denied: timed out getting labels from cloud provider %s: %v", provider, err)
+			return denied(request.UID, http.StatusGatewayTimeout, metav1.StatusReasonTimeout,
+				fmt.Sprintf("timed out getting labels for PersistentVolume %s from cloud provider %s: %v", pv.Name, provider, err))
+		}
 		if err != nil {
-			e := fmt.Sprintf("could not marshal admission response: %v", err)
-			http.Error(w, e, http.StatusInternalServerError)
-			return
+			klog.ErrorS(err, "failed to get volume labels", "uid", request.UID, "pv", klog.KObj(pv))
+			outcome, reason = metrics.OutcomeRejected, "cloud_error"
+			p.event(ctx, pv, corev1.EventTypeWarning, EventReasonLabelingFailed, "Denied: error getting labels from cloud provider %s: %v", provider, err)
+			return denied(request.UID, http.StatusForbidden, metav1.StatusReasonForbidden,
+				fmt.Sprintf("error getting labels for PersistentVolume %s from cloud provider %s: %v", pv.Name, provider, err))
+		}
+		if source == auditlog.LabelSourceExisting {
+			p.event(ctx, pv, corev1.EventTypeNormal, EventReasonTrustedLabels, "Labels %v set by the provisioner used instead of looking them up from cloud provider %s", volumeLabels, provider)
 		}
+	}
+	switch {
+	case preserved:
+		record.LabelSource = auditlog.LabelSourcePreserved
+	case source != "":
+		record.LabelSource = source
+	case len(volumeLabels) > 0:
+		record.LabelSource = auditlog.LabelSourceLookup
+	}
+	record.Labels = volumeLabels
 
-		fmt.Fprintf(w, "%s", outBytes)
-		return
+	newPV := pv.DeepCopy()
+	var warnings []string
+	if oldPV != nil && oldPV.Spec.NodeAffinity != nil {
+		// The node affinity cannot be changed once set, only update the labels
+		p.setLabels(newPV, volumeLabels)
+		record.NodeAffinity = auditlog.NodeAffinityImmutable
+	} else {
+		var err error
+		_, span := p.tracer.Start(ctx, "mutatePV")
+		warnings, err = p.mutatePV(newPV, volumeLabels)
+		endSpan(span, err)
+		if errors.Is(err, ErrNodeAffinityConflict) {
+			klog.ErrorS(err, "failed to merge node affinity", "uid", request.UID, "pv", klog.KObj(pv), "labels", volumeLabels)
+			record.NodeAffinity = auditlog.NodeAffinityConflict
+			outcome, reason = metrics.OutcomeRejected, "node_affinity_conflict"
+			p.event(ctx, pv, corev1.EventTypeWarning, EventReasonNodeAffinityConflict, "Denied: error adding node affinity for labels %v: %v", volumeLabels, err)
+			return denied(request.UID, http.StatusUnprocessableEntity, metav1.StatusReasonInvalid,
+				fmt.Sprintf("error adding node affinity for labels %v to PersistentVolume %s: %v", volumeLabels, pv.Name, err))
+		}
+		if err != nil {
+			klog.ErrorS(err, "failed to add labels and node affinity", "uid", request.UID, "pv", klog.KObj(pv), "labels", volumeLabels)
+			outcome, reason = metrics.OutcomeRejected, "invalid_labels"
+			p.event(ctx, pv, corev1.EventTypeWarning, EventReasonInvalidLabels, "Denied: error adding labels %v: %v", volumeLabels, err)
+			return denied(request.UID, http.StatusUnprocessableEntity, metav1.StatusReasonInvalid,
+				fmt.Sprintf("error adding labels %v to PersistentVolume %s: %v", volumeLabels, pv.Name, err))
+		}
+		switch {
+		case len(warnings) > 0:
+			record.NodeAffinity = auditlog.NodeAffinityMerged
+			p.event(ctx, pv, corev1.EventTypeWarning, EventReasonNodeAffinityConflict, "Node affinity merged with labels %v according to node affinity strategy %s: %s",
+				volumeLabels, p.nodeAffinityStrategy(), strings.Join(warnings, "; "))
+		case len(volumeLabels) > 0:
+			record.NodeAffinity = auditlog.NodeAffinityAdded
+		}
+	}
+	delete(newPV.Annotations, AnnPendingLabels)
+	setLabelSource(newPV, source)
+	if preserved && apiequality.Semantic.DeepEqual(pv, newPV) {
+		outcome, reason = metrics.OutcomeSkipped, "unchanged"
+		return allowed
+	}
+	if len(volumeLabels) == 0 && apiequality.Semantic.DeepEqual(pv, newPV) {
+		outcome, reason = metrics.OutcomeSkipped, "no_labels"
+		return allowed
 	}
 
-	volumeLabels, err := p.getVolumeLabels(pv)
+	_, span := p.tracer.Start(ctx, "getPatchBytes")
+	patchBytes, err := p.getPatchBytes(pv, newPV)
+	endSpan(span, err)
 	if err != nil {
-		w.WriteHeader(http.StatusForbidden)
-		return
+		klog.ErrorS(err, "failed to create patch", "uid", request.UID, "pv", klog.KObj(pv))
+		reason = "patch_error"
+		return denied(request.UID, http.StatusInternalServerError, metav1.StatusReasonInternalError,
+			fmt.Sprintf("error creating patch for PersistentVolume %s: %v", pv.Name, err))
+	}
+
+	switch {
+	case preserved:
+		outcome, reason = metrics.OutcomeLabeled, "preserved"
+	case len(volumeLabels) == 0:
+		outcome, reason = metrics.OutcomeSkipped, "no_labels"
+	default:
+		outcome, reason = metrics.OutcomeLabeled, "patched"
+	}
+
+	patchType := admissionv1.PatchTypeJSONPatch
+	return &admissionv1.AdmissionResponse{
+		UID:       request.UID,
+		Allowed:   true,
+		PatchType: &patchType,
+		Patch:     patchBytes,
+		Warnings:  warnings,
+	}
+}
+
+// validate handles a decoded validating admission request and returns the
+// response to it. The PV's topology is compared with the cloud provider's
+// even if the PV is dynamically provisioned.
+func (p *PVLabelAdmission) validate(ctx context.Context, request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	start := time.Now()
+	volumeType := volumeTypeUnknown
+	provider := p.cloudProvider
+	outcome, reason := metrics.OutcomeError, "internal_error"
+	defer func() {
+		metrics.RecordAdmission(provider, volumeType, outcome, reason, time.Since(start))
+	}()
+
+	if request.Kind.Kind != "PersistentVolume" {
+		err := fmt.Errorf("unsupported kind %s, only PersistentVolumes are handled", request.Kind.Kind)
+		klog.ErrorS(err, "failed to handle admission request", "uid", request.UID, "name", request.Name)
+		reason = "unsupported_kind"
+		return denied(request.UID, http.StatusBadRequest, metav1.StatusReasonBadRequest, err.Error())
+	}
+
+	pv := &corev1.PersistentVolume{}
+	if err := json.Unmarshal(request.Object.Raw, pv); err != nil {
+		klog.ErrorS(err, "failed to decode PersistentVolume", "uid", request.UID, "pv", request.Name)
+		reason = "decode_error"
+		return denied(request.UID, http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("failed to decode PersistentVolume: %v", err))
+	}
+	volumeType = getVolumeType(pv)
+	provider = p.providerName(pv)
+
+	allowed := &admissionv1.AdmissionResponse{
+		UID:     request.UID,
+		Allowed: true,
+	}
+	if !p.CanLabel(pv) {
+		outcome, reason = metrics.OutcomeAllowed, "unsupported_volume"
+		return allowed
+	}
+
+	if request.Operation == admissionv1.Update {
+		oldPV := &corev1.PersistentVolume{}
+		if err := json.Unmarshal(request.OldObject.Raw, oldPV); err != nil {
+			klog.ErrorS(err, "failed to decode old PersistentVolume", "uid", request.UID, "pv", request.Name)
+			reason = "decode_error"
+			return denied(request.UID, http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("failed to decode old PersistentVolume: %v", err))
+		}
+		// Do not block unrelated updates, e.g. removing finalizers, of PVs
+		// whose topology is already wrong.
+		if apiequality.Semantic.DeepEqual(oldPV.Labels, pv.Labels) && apiequality.Semantic.DeepEqual(oldPV.Spec.NodeAffinity, pv.Spec.NodeAffinity) {
+			outcome, reason = metrics.OutcomeAllowed, "unchanged"
+			return allowed
+		}
+	}
+
+	if p.options.CloudRequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.options.CloudRequestTimeout)
+		defer cancel()
+	}
+
+	cloudLabels, _, err := p.lookupVolumeLabels(ctx, pv, false)
+	if err != nil && p.options.FailurePolicy == FailurePolicyOpen {
+		klog.ErrorS(err, "failed to get volume labels, admitting PersistentVolume without validation", "uid", request.UID, "pv", klog.KObj(pv))
+		outcome, reason = metrics.OutcomeAllowed, "cloud_error"
+		allowed.Warnings = []string{fmt.Sprintf("topology of PersistentVolume %s not validated: error getting labels from cloud provider %s: %v", pv.Name, provider, err)}
+		p.event(ctx, pv, corev1.EventTypeWarning, EventReasonTopologyNotValidated, "Admitted without topology validation: error getting labels from cloud provider %s: %v", provider, err)
+		return allowed
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		klog.ErrorS(err, "timed out getting volume labels", "uid", request.UID, "pv", klog.KObj(pv))
+		outcome, reason = metrics.OutcomeRejected, "cloud_timeout"
+		p.event(ctx, pv, corev1.EventTypeWarning, EventReasonLabelingFailed, "Denied: timed out getting labels from cloud provider %s to validate topology: %v", provider, err)
+		return denied(request.UID, http.StatusGatewayTimeout, metav1.StatusReasonTimeout,
+			fmt.Sprintf("timed out getting labels for PersistentVolume %s from cloud provider %s: %v", pv.Name, provider, err))
+	}
+	if err != nil {
+		klog.ErrorS(err, "failed to get volume labels", "uid", request.UID, "pv", klog.KObj(pv))
+		outcome, reason = metrics.OutcomeRejected, "cloud_error"
+		p.event(ctx, pv, corev1.EventTypeWarning, EventReasonLabelingFailed, "Denied: error getting labels from cloud provider %s to validate topology: %v", provider, err)
+		return denied(request.UID, http.StatusForbidden, metav1.StatusReasonForbidden,
+			fmt.Sprintf("error getting labels for PersistentVolume %s from cloud provider %s: %v", pv.Name, provider, err))
+	}
+
+	if differences := CompareTopology(pv, cloudLabels); len(differences) > 0 {
+		messages := make([]string, 0, len(differences))
+		for _, difference := range differences {
+			messages = append(messages, difference.String())
+		}
+		klog.InfoS("Denying PersistentVolume with wrong topology", "uid", request.UID, "pv", klog.KObj(pv), "differences", messages)
+		outcome, reason = metrics.OutcomeRejected, "topology_mismatch"
+		p.event(ctx, pv, corev1.EventTypeWarning, EventReasonTopologyMismatch, "Denied: topology contradicts cloud provider %s: %s", provider, strings.Join(messages, "; "))
+		return denied(request.UID, http.StatusUnprocessableEntity, metav1.StatusReasonInvalid,
+			fmt.Sprintf("topology of PersistentVolume %s contradicts cloud provider %s: %s", pv.Name, provider, strings.Join(messages, "; ")))
+	}
+
+	outcome, reason = metrics.OutcomeAllowed, "validated"
+	return allowed
+}
+
+// Label runs the labeling pipeline on a PV outside of an admission request. It
+// returns the PV with labels and node affinity added and the JSON patch
+// that the webhook would return for it.
+func (p *PVLabelAdmission) Label(ctx context.Context, pv *corev1.PersistentVolume) (*corev1.PersistentVolume, []byte, error) {
+	if p.options.CloudRequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.options.CloudRequestTimeout)
+		defer cancel()
+	}
+
+	if !p.CanLabel(pv) {
+		// The webhook admits these volumes unchanged
+		return pv.DeepCopy(), nil, nil
+	}
+
+	volumeLabels, source, err := p.getVolumeLabels(ctx, pv)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting labels from cloud provider %s: %w", p.providerName(pv), err)
 	}
 
-	oldPV := pv.DeepCopy()
 	newPV := pv.DeepCopy()
-	err = p.mutatePV(newPV, volumeLabels)
+	if _, err := p.mutatePV(newPV, volumeLabels); err != nil {
+		return nil, nil, fmt.Errorf("error adding labels %v: %w", volumeLabels, err)
+	}
+	setLabelSource(newPV, source)
+
+	patchBytes, err := p.getPatchBytes(pv, newPV)
 	if err != nil {
-		w.WriteHeader(http.StatusForbidden)
-		return
+		return nil, nil, fmt.Errorf("error creating patch: %w", err)
+	}
+
+	return newPV, patchBytes, nil
+}
+
+// LabelPatch returns a JSON merge patch adding the cloud provider labels
+// missing from an existing PV, stripping its beta labels if configured,
+// removing its AnnPendingLabels annotation and updating its AnnLabelSource
+// annotation. The patch only sets or removes these keys, so labels and
+// annotations changed by others since the PV was read are kept.
+// Unlike Label, the patch leaves the node affinity alone, but it is added by
+// the webhook when the patch is admitted as an update of a PV without node
+// affinity. The patch is nil if the PV is already labeled.
+func (p *PVLabelAdmission) LabelPatch(ctx context.Context, pv *corev1.PersistentVolume) ([]byte, error) {
+	if p.options.CloudRequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.options.CloudRequestTimeout)
+		defer cancel()
 	}
 
-	patchBytes, err := p.getPatchBytes(oldPV, newPV)
+	volumeLabels, source, err := p.getVolumeLabels(ctx, pv)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("error getting labels from cloud provider %s: %w", p.providerName(pv), err)
+	}
+
+	newPV := pv.DeepCopy()
+	p.setLabels(newPV, volumeLabels)
+	delete(newPV.Annotations, AnnPendingLabels)
+	setLabelSource(newPV, source)
+	if apiequality.Semantic.DeepEqual(pv.ObjectMeta, newPV.ObjectMeta) {
+		return nil, nil
+	}
+
+	metadata := make(map[string]interface{})
+	if labels := mergePatchMap(pv.Labels, newPV.Labels); len(labels) > 0 {
+		metadata["labels"] = labels
+	}
+	if annotations := mergePatchMap(pv.Annotations, newPV.Annotations); len(annotations) > 0 {
+		metadata["annotations"] = annotations
+	}
+	patchBytes, err := json.Marshal(map[string]interface{}{"metadata": metadata})
+	if err != nil {
+		return nil, fmt.Errorf("error creating patch: %w", err)
+	}
+
+	return patchBytes, nil
+}
+
+// mergePatchMap returns the JSON merge patch turning the old map into the new
+// one: the keys that were added or changed with their new value, and the keys
+// that were removed with a null value.
+func mergePatchMap(oldMap, newMap map[string]string) map[string]interface{} {
+	patch := make(map[string]interface{})
+	for key, value := range newMap {
+		if oldValue, ok := oldMap[key]; !ok || oldValue != value {
+			patch[key] = value
+		}
+	}
+	for key := range oldMap {
+		if _, ok := newMap[key]; !ok {
+			patch[key] = nil
+		}
+	}
+	return patch
+}
+
+// IsLabeled returns true if the PV is not pending and already has zone and
+// region labels set according to the LabelPolicy, without beta labels left to
+// strip, so that existing PVs can be checked without looking them up.
+func (p *PVLabelAdmission) IsLabeled(pv *corev1.PersistentVolume) bool {
+	if metav1.HasAnnotation(pv.ObjectMeta, AnnPendingLabels) {
+		return false
+	}
+
+	topologyLabels := make(map[string]string)
+	for key := range equivalentLabels {
+		if value, ok := pv.Labels[key]; ok {
+			topologyLabels[key] = value
+		}
+	}
+	for _, key := range []string{corev1.LabelTopologyZone, corev1.LabelTopologyRegion} {
+		if _, ok := topologyLabels[key]; !ok {
+			if _, ok := topologyLabels[equivalentLabels[key]]; !ok {
+				return false
+			}
+		}
+	}
+
+	for key, value := range applyLabelPolicy(p.options.LabelPolicy, topologyLabels) {
+		if pv.Labels[key] != value {
+			return false
+		}
+	}
+	if p.options.StripBetaLabels {
+		for _, key := range betaLabels {
+			if _, ok := pv.Labels[key]; ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// CloudLabels looks up the labels of the PV's volume from the cloud provider,
+// even if the PV is dynamically provisioned and already has topology labels.
+// It returns nil if the volume is not one the cloud provider can look up.
+func (p *PVLabelAdmission) CloudLabels(ctx context.Context, pv *corev1.PersistentVolume) (map[string]string, error) {
+	if p.options.CloudRequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.options.CloudRequestTimeout)
+		defer cancel()
+	}
+
+	labels, _, err := p.lookupVolumeLabels(ctx, pv, false)
+	if err != nil {
+		return nil, fmt.Errorf("error getting labels from cloud provider %s: %w", p.providerName(pv), err)
+	}
+	return labels, nil
+}
+
+// admitPending returns a response admitting the PV without labels. The PV is
+// annotated with AnnPendingLabels so it can be labeled once the cloud provider
+// is available again.
+func (p *PVLabelAdmission) admitPending(uid types.UID, pv *corev1.PersistentVolume, lookupErr error) *admissionv1.AdmissionResponse {
+	newPV := pv.DeepCopy()
+	metav1.SetMetaDataAnnotation(&newPV.ObjectMeta, AnnPendingLabels, time.Now().UTC().Format(time.RFC3339))
+
+	patchBytes, err := p.getPatchBytes(pv, newPV)
+	if err != nil {
+		klog.ErrorS(err, "failed to create patch", "uid", uid, "pv", klog.KObj(pv))
+		return denied(uid, http.StatusInternalServerError, metav1.StatusReasonInternalError,
+			fmt.Sprintf("error creating patch for PersistentVolume %s: %v", pv.Name, err))
 	}
 
 	patchType := admissionv1.PatchTypeJSONPatch
+	return &admissionv1.AdmissionResponse{
+		UID:       uid,
+		Allowed:   true,
+		PatchType: &patchType,
+		Patch:     patchBytes,
+		Warnings: []string{
+			fmt.Sprintf("PersistentVolume %s was admitted without topology labels because they could not be retrieved from cloud provider %s: %v",
+				pv.Name, p.providerName(pv), lookupErr),
+		},
+	}
+}
+
+// audit writes the audit record of the request and its response, if an audit
+// log is configured. Dry-run requests are not audited since the webhooks
+// declare sideEffects: NoneOnDryRun.
+func (p *PVLabelAdmission) audit(request *admissionv1.AdmissionRequest, record *auditlog.Record, response *admissionv1.AdmissionResponse, start time.Time) {
+	if p.options.AuditLog == nil || (request.DryRun != nil && *request.DryRun) {
+		return
+	}
+
+	record.Time = start.UTC()
+	record.UID = request.UID
+	record.Operation = string(request.Operation)
+	record.User = request.UserInfo.Username
+	if record.NodeAffinity != "" {
+		record.NodeAffinityStrategy = string(p.nodeAffinityStrategy())
+	}
+	record.Allowed = response.Allowed
+	record.Patch = response.Patch
+	record.Warnings = response.Warnings
+	if response.Result != nil {
+		record.Message = response.Result.Message
+	}
+	record.LatencySeconds = time.Since(start).Seconds()
+	p.options.AuditLog.Log(record)
+}
+
+// writeResponse writes the admission response wrapped in an AdmissionReview.
+func (p *PVLabelAdmission) writeResponse(w http.ResponseWriter, response *admissionv1.AdmissionResponse) {
 	resp := &admissionv1.AdmissionReview{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "AdmissionReview",
 			APIVersion: "admission.k8s.io/v1",
 		},
-		Response: &admissionv1.AdmissionResponse{
-			UID:       admissionReview.Request.UID,
-			Allowed:   true,
-			PatchType: &patchType,
-			Patch:     patchBytes,
-		},
+		Response: response,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -141,6 +742,20 @@ func (p *PVLabelAdmission) Admit(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "%s", outBytes)
 }
 
+// denied returns a response denying the request with the given status.
+func denied(uid types.UID, code int32, reason metav1.StatusReason, message string) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		UID:     uid,
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: message,
+			Reason:  reason,
+			Code:    code,
+		},
+	}
+}
+
 func (p *PVLabelAdmission) getPatchBytes(oldPV, newPV *corev1.PersistentVolume) ([]byte, error) {
 	patch, err := jsondiff.Compare(oldPV, newPV)
 	if err != nil {
@@ -155,25 +770,26 @@ func (p *PVLabelAdmission) getPatchBytes(oldPV, newPV *corev1.PersistentVolume)
 	return patchBytes, err
 }
 
-func (p *PVLabelAdmission) mutatePV(pv *corev1.PersistentVolume, volumeLabels map[string]string) error {
-	requirements := make([]corev1.NodeSelectorRequirement, 0)
-
-	if pv.Labels == nil {
-		pv.Labels = make(map[string]string)
+// mutatePV sets the volume labels on the PV and adds node affinity
+// requirements for them, merged with the PV's node affinity according to the
+// configured NodeAffinityStrategy. It returns warnings explaining how
+// conflicts with the PV's node affinity were resolved. The PV is left
+// unchanged without volume labels: an empty node selector term would match no
+// node.
+func (p *PVLabelAdmission) mutatePV(pv *corev1.PersistentVolume, volumeLabels map[string]string) ([]string, error) {
+	if len(volumeLabels) == 0 {
+		return nil, nil
 	}
+	p.setLabels(pv, volumeLabels)
 
+	requirements := make([]corev1.NodeSelectorRequirement, 0)
 	for k, v := range volumeLabels {
-		// We (silently) replace labels if they are provided.
-		// This should be OK because they are in the kubernetes.io namespace
-		// i.e. we own them
-		pv.Labels[k] = v
-
 		// Set NodeSelectorRequirements based on the labels
 		var values []string
-		if k == v1.LabelTopologyZone || k == v1.LabelFailureDomainBetaZone {
+		if isZoneLabel(k) {
 			zones, err := volumehelpers.LabelZonesToSet(v)
 			if err != nil {
-				return fmt.Errorf("failed to convert label string for Zone: %s to a Set", v)
+				return nil, fmt.Errorf("failed to convert label string for Zone: %s to a Set", v)
 			}
 			// zone values here are sorted for better testability.
 			values = zones.List()
@@ -182,6 +798,7 @@ func (p *PVLabelAdmission) mutatePV(pv *corev1.PersistentVolume, volumeLabels ma
 		}
 		requirements = append(requirements, corev1.NodeSelectorRequirement{Key: k, Operator: corev1.NodeSelectorOpIn, Values: values})
 	}
+	sortRequirements(requirements)
 
 	if pv.Spec.NodeAffinity == nil {
 		pv.Spec.NodeAffinity = new(corev1.VolumeNodeAffinity)
@@ -193,21 +810,120 @@ func (p *PVLabelAdmission) mutatePV(pv *corev1.PersistentVolume, volumeLabels ma
 		// Need at least one term pre-allocated whose MatchExpressions can be appended to
 		pv.Spec.NodeAffinity.Required.NodeSelectorTerms = make([]corev1.NodeSelectorTerm, 1)
 	}
-	if nodeSelectorRequirementKeysExistInNodeSelectorTerms(requirements, pv.Spec.NodeAffinity.Required.NodeSelectorTerms) {
-		klog.V(4).Infof("NodeSelectorRequirements for cloud labels %v conflict with existing NodeAffinity %v. Skipping addition of NodeSelectorRequirements for cloud labels.",
-			requirements, pv.Spec.NodeAffinity)
-	} else {
-		for _, req := range requirements {
-			for i := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
-				pv.Spec.NodeAffinity.Required.NodeSelectorTerms[i].MatchExpressions = append(pv.Spec.NodeAffinity.Required.NodeSelectorTerms[i].MatchExpressions, req)
-			}
+
+	strategy := p.nodeAffinityStrategy()
+	warnings, err := mergeNodeAffinity(strategy, pv, requirements)
+	if err != nil {
+		return nil, err
+	}
+	for _, warning := range warnings {
+		klog.InfoS("Merged node affinity with cloud provider topology", "pv", klog.KObj(pv), "strategy", strategy, "result", warning)
+	}
+
+	return warnings, nil
+}
+
+// nodeAffinityStrategy returns the configured NodeAffinityStrategy.
+func (p *PVLabelAdmission) nodeAffinityStrategy() NodeAffinityStrategy {
+	if p.options.NodeAffinityStrategy == "" {
+		return NodeAffinityStrategySkip
+	}
+	return p.options.NodeAffinityStrategy
+}
+
+// setLabels sets the volume labels on the PV and strips its beta labels if
+// configured.
+func (p *PVLabelAdmission) setLabels(pv *corev1.PersistentVolume, volumeLabels map[string]string) {
+	setVolumeLabels(pv, volumeLabels)
+	if p.options.StripBetaLabels && len(volumeLabels) > 0 {
+		stripBetaLabels(pv, volumeLabels)
+	}
+}
+
+// preservedVolumeLabels returns the topology labels set on the PV before an
+// update, so that they are not looked up again while its volume source is
+// unchanged. The LabelPolicy is applied to them like to looked up labels. It
+// returns false if the old PV was not labeled.
+func (p *PVLabelAdmission) preservedVolumeLabels(oldPV, pv *corev1.PersistentVolume) (map[string]string, bool) {
+	if oldPV == nil || metav1.HasAnnotation(oldPV.ObjectMeta, AnnPendingLabels) ||
+		!apiequality.Semantic.DeepEqual(oldPV.Spec.PersistentVolumeSource, pv.Spec.PersistentVolumeSource) {
+		return nil, false
+	}
+
+	keys := []string{corev1.LabelTopologyZone, corev1.LabelTopologyRegion, corev1.LabelFailureDomainBetaZone, corev1.LabelFailureDomainBetaRegion}
+	if pv.Spec.CSI != nil {
+		for _, key := range csiDriverTopologyKeys[pv.Spec.CSI.Driver] {
+			keys = append(keys, key)
 		}
 	}
 
-	return nil
+	labels := make(map[string]string)
+	for _, key := range keys {
+		if value, ok := oldPV.Labels[key]; ok {
+			labels[key] = value
+		}
+	}
+	if _, ok := labels[corev1.LabelTopologyZone]; !ok {
+		if _, ok := labels[corev1.LabelFailureDomainBetaZone]; !ok {
+			return nil, false
+		}
+	}
+	return applyLabelPolicy(p.options.LabelPolicy, labels), true
+}
+
+// setVolumeLabels sets the volume labels on the PV.
+func setVolumeLabels(pv *corev1.PersistentVolume, volumeLabels map[string]string) {
+	if pv.Labels == nil {
+		pv.Labels = make(map[string]string)
+	}
+
+	for k, v := range volumeLabels {
+		// We (silently) replace labels if they are provided.
+		// This should be OK because they are in the kubernetes.io namespace
+		// i.e. we own them
+		pv.Labels[k] = v
+	}
+}
+
+// getVolumeLabels returns the labels of the PV's volume according to the
+// LabelPolicy, and their label source as returned by lookupVolumeLabels.
+func (p *PVLabelAdmission) getVolumeLabels(ctx context.Context, pv *corev1.PersistentVolume) (map[string]string, string, error) {
+	ctx, span := p.tracer.Start(ctx, "getVolumeLabels")
+	labels, source, err := p.lookupVolumeLabels(ctx, pv, true)
+	endSpan(span, err)
+	if err != nil {
+		return nil, "", err
+	}
+	return applyLabelPolicy(p.options.LabelPolicy, labels), source, nil
 }
 
-func (p *PVLabelAdmission) getVolumeLabels(pv *corev1.PersistentVolume) (map[string]string, error) {
+// lookupVolumeLabels returns the labels of the PV's volume. When labeling the
+// PV, the zone and region labels of dynamically provisioned PVs are returned
+// as is instead of being looked up, and the LabelSources are used instead of
+// the PVLabelers. The label source is also returned:
+// auditlog.LabelSourceExisting for trusted labels, or the source reported by
+// the PV's labeler, if any.
+func (p *PVLabelAdmission) lookupVolumeLabels(ctx context.Context, pv *corev1.PersistentVolume, labeling bool) (map[string]string, string, error) {
+	provider, configured := p.volumeLabeler(pv)
+	if configured && provider != InferenceProvider && isSupportedCSIVolume(pv) {
+		// Look up CSI volumes through their in-tree equivalent and add the
+		// driver's own topology keys next to the Kubernetes topology labels.
+		inTreePV, err := translateCSIPV(pv)
+		if err != nil {
+			return nil, "", err
+		}
+		if inTreePV.Spec.VsphereVolume != nil && inTreePV.Spec.VsphereVolume.VolumePath == "" {
+			// vSphere CSI volumes without a migrated volume path cannot be looked up
+			return nil, "", nil
+		}
+
+		labels, source, err := p.lookupVolumeLabels(ctx, inTreePV, labeling)
+		if err != nil {
+			return nil, "", err
+		}
+		return addCSITopologyLabels(pv.Spec.CSI.Driver, labels), source, nil
+	}
+
 	existingLabels := pv.Labels
 
 	// All cloud providers set only these two labels.
@@ -223,61 +939,226 @@ func (p *PVLabelAdmission) getVolumeLabels(pv *corev1.PersistentVolume) (map[str
 	}
 
 	isDynamicallyProvisioned := metav1.HasAnnotation(pv.ObjectMeta, storagehelpers.AnnDynamicallyProvisioned)
-	if isDynamicallyProvisioned && domainOK && regionOK {
+	if labeling && isDynamicallyProvisioned && domainOK && regionOK {
 		// PV already has all the labels and we can trust the dynamic provisioning that it provided correct values.
 		if topologyLabelGA {
 			return map[string]string{
 				v1.LabelTopologyZone:   domain,
 				v1.LabelTopologyRegion: region,
-			}, nil
+			}, auditlog.LabelSourceExisting, nil
 		}
 		return map[string]string{
 			v1.LabelFailureDomainBetaZone:   domain,
 			v1.LabelFailureDomainBetaRegion: region,
-		}, nil
+		}, auditlog.LabelSourceExisting, nil
 
 	}
 
+	if !configured {
+		// Volumes of other storage platforms are labeled by the external labeler, if any
+		return p.queryVolumeLabels(ctx, ExternalProvider, pv, "volume of PersistentVolume "+pv.Name, labeling)
+	}
+
 	switch {
-	case p.cloudProvider == "gce" && pv.Spec.GCEPersistentDisk != nil:
-		labels, err := p.pvLabeler.GetLabelsForVolume(context.Background(), pv)
-		if err != nil {
-			return nil, fmt.Errorf("error querying GCE PD volume %s: %v", pv.Spec.GCEPersistentDisk.PDName, err)
-		}
-		return labels, nil
-	case p.cloudProvider == "azure" && pv.Spec.AzureDisk != nil:
-		labels, err := p.pvLabeler.GetLabelsForVolume(context.Background(), pv)
+	case pv.Spec.GCEPersistentDisk != nil:
+		return p.queryVolumeLabels(ctx, provider, pv, "GCE PD volume "+pv.Spec.GCEPersistentDisk.PDName, labeling)
+	case pv.Spec.AzureDisk != nil:
+		return p.queryVolumeLabels(ctx, provider, pv, "AzureDisk volume "+pv.Spec.AzureDisk.DiskName, labeling)
+	case pv.Spec.AWSElasticBlockStore != nil:
+		return p.queryVolumeLabels(ctx, provider, pv, "AWS EBS Volume "+pv.Spec.AWSElasticBlockStore.VolumeID, labeling)
+	case pv.Spec.VsphereVolume != nil:
+		return p.queryVolumeLabels(ctx, provider, pv, "vSphere Volume "+pv.Spec.VsphereVolume.VolumePath, labeling)
+	case isSupportedCSIVolume(pv):
+		// Only the inference labeler gets CSI volumes, whose handles may encode
+		// their location unlike the in-tree equivalent.
+		labels, source, err := p.queryVolumeLabels(ctx, provider, pv, "CSI volume "+pv.Spec.CSI.VolumeHandle, labeling)
 		if err != nil {
-			return nil, fmt.Errorf("error querying AzureDisk volume %s: %v", pv.Spec.AzureDisk.DiskName, err)
+			return nil, "", err
 		}
-		return labels, nil
-	case p.cloudProvider == "aws" && pv.Spec.AWSElasticBlockStore != nil:
-		labels, err := p.pvLabeler.GetLabelsForVolume(context.Background(), pv)
-		if err != nil {
-			return nil, fmt.Errorf("error querying AWS EBS Volume %s: %v", pv.Spec.AWSElasticBlockStore.VolumeID, err)
-		}
-		return labels, nil
-	case p.cloudProvider == "vsphere" && pv.Spec.VsphereVolume != nil:
-		labels, err := p.pvLabeler.GetLabelsForVolume(context.Background(), pv)
-		if err != nil {
-			return nil, fmt.Errorf("error querying vSphere Volume %s: %v", pv.Spec.VsphereVolume.VolumePath, err)
-		}
-		return labels, nil
+		return addCSITopologyLabels(pv.Spec.CSI.Driver, labels), source, nil
 	}
 
 	// Unrecognized volume, do not add any labels
-	return nil, nil
+	return nil, "", nil
 }
 
-func nodeSelectorRequirementKeysExistInNodeSelectorTerms(reqs []corev1.NodeSelectorRequirement, terms []corev1.NodeSelectorTerm) bool {
-	for _, req := range reqs {
-		for _, term := range terms {
-			for _, r := range term.MatchExpressions {
-				if r.Key == req.Key {
-					return true
-				}
-			}
+// queryVolumeLabels looks up the labels of the PV's volume from the given
+// cloud provider, or from its LabelSources when labeling the PV. Volumes of
+// cloud providers that are not configured are not labeled.
+func (p *PVLabelAdmission) queryVolumeLabels(ctx context.Context, provider string, pv *corev1.PersistentVolume, volume string, labeling bool) (map[string]string, string, error) {
+	pvLabeler, ok := p.pvLabelers[provider]
+	if !ok {
+		return nil, "", nil
+	}
+	if sourceLabeler, ok := p.options.LabelSources[provider]; ok && labeling {
+		pvLabeler = sourceLabeler
+	}
+
+	labels, source, err := p.getCloudLabels(ctx, provider, pvLabeler, pv)
+	if err != nil {
+		return nil, "", fmt.Errorf("error querying %s: %w", volume, err)
+	}
+	return labels, source, nil
+}
+
+// volumeProvider returns the name of the cloud provider the PV's volume
+// source belongs to, or an empty string if it belongs to none.
+func volumeProvider(pv *corev1.PersistentVolume) string {
+	switch {
+	case pv.Spec.GCEPersistentDisk != nil:
+		return "gce"
+	case pv.Spec.AzureDisk != nil:
+		return "azure"
+	case pv.Spec.AWSElasticBlockStore != nil:
+		return "aws"
+	case pv.Spec.VsphereVolume != nil:
+		return "vsphere"
+	case pv.Spec.CSI != nil:
+		return csiDriverProviders[pv.Spec.CSI.Driver]
+	}
+	return ""
+}
+
+// providerName returns the name of the cloud provider labeling the PV, or the
+// names of all the configured cloud providers if none of them labels it.
+func (p *PVLabelAdmission) providerName(pv *corev1.PersistentVolume) string {
+	if provider, ok := p.volumeLabeler(pv); ok {
+		return provider
+	}
+	if _, ok := p.pvLabelers[ExternalProvider]; ok {
+		return ExternalProvider
+	}
+	return p.cloudProvider
+}
+
+// volumeLabeler returns the name of the labeler of the PV's volume: the cloud
+// provider it belongs to or, if it is not configured, the static labeler or
+// else the inference labeler. It returns false if none of them is configured.
+func (p *PVLabelAdmission) volumeLabeler(pv *corev1.PersistentVolume) (string, bool) {
+	provider := volumeProvider(pv)
+	if _, ok := p.pvLabelers[provider]; ok {
+		return provider, true
+	}
+	if _, ok := p.pvLabelers[StaticProvider]; ok && IsLabelableVolume(pv) {
+		return StaticProvider, true
+	}
+	if _, ok := p.pvLabelers[InferenceProvider]; ok && IsLabelableVolume(pv) {
+		return InferenceProvider, true
+	}
+	return "", false
+}
+
+// CanLabel returns true if the PV's volume can be labeled by one of the
+// configured labelers. With an external labeler, every PV is sent to it unless
+// its volume belongs to one of the other cloud providers.
+func (p *PVLabelAdmission) CanLabel(pv *corev1.PersistentVolume) bool {
+	if _, ok := p.pvLabelers[ExternalProvider]; ok {
+		return true
+	}
+	return IsLabelableVolume(pv)
+}
+
+// IsLabelableVolume returns true if the PV's volume source is one that can be
+// labeled from a cloud provider.
+func IsLabelableVolume(pv *corev1.PersistentVolume) bool {
+	return pv.Spec.GCEPersistentDisk != nil || pv.Spec.AzureDisk != nil ||
+		pv.Spec.AWSElasticBlockStore != nil || pv.Spec.VsphereVolume != nil ||
+		isSupportedCSIVolume(pv)
+}
+
+// getCloudLabels looks up the labels of the PV's volume from the cloud provider.
+// Not all cloud providers honor the context, so the lookup is abandoned
+// once the context is done even if the provider call is still running.
+// The name of the label source is also returned if the labeler reports it.
+func (p *PVLabelAdmission) getCloudLabels(ctx context.Context, provider string, pvLabeler cloudprovider.PVLabeler, pv *corev1.PersistentVolume) (map[string]string, string, error) {
+	type result struct {
+		labels map[string]string
+		source string
+		err    error
+	}
+
+	ctx, span := p.tracer.Start(ctx, "GetLabelsForVolume", trace.WithAttributes(
+		attribute.String("pv.provider", provider),
+		attribute.String("pv.volume_type", getVolumeType(pv)),
+	))
+
+	start := time.Now()
+	resultCh := make(chan result, 1)
+	go func() {
+		if sourceLabeler, ok := pvLabeler.(labeler.SourceLabeler); ok {
+			labels, source, err := sourceLabeler.GetLabelsAndSourceForVolume(ctx, pv)
+			resultCh <- result{labels: labels, source: source, err: err}
+			return
 		}
+		labels, err := pvLabeler.GetLabelsForVolume(ctx, pv)
+		resultCh <- result{labels: labels, err: err}
+	}()
+
+	var res result
+	select {
+	case res = <-resultCh:
+	case <-ctx.Done():
+		res.err = ctx.Err()
+	}
+
+	metrics.RecordCloudRequest(provider, getVolumeType(pv), res.err, time.Since(start))
+	if res.source != "" {
+		span.SetAttributes(attribute.String("pv.label_source", res.source))
+	}
+	endSpan(span, res.err)
+	return res.labels, res.source, res.err
+}
+
+// endSpan records the error, if any, on the span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// setLabelSource records the label source that supplied the PV's labels,
+// unless they are its own existing labels.
+func setLabelSource(pv *corev1.PersistentVolume, source string) {
+	if source != "" && source != auditlog.LabelSourceExisting {
+		metav1.SetMetaDataAnnotation(&pv.ObjectMeta, AnnLabelSource, source)
+	}
+}
+
+// getVolumeID returns the identity of the PV's volume, as recorded in the
+// audit log.
+func getVolumeID(pv *corev1.PersistentVolume) string {
+	switch {
+	case pv.Spec.GCEPersistentDisk != nil:
+		return pv.Spec.GCEPersistentDisk.PDName
+	case pv.Spec.AzureDisk != nil:
+		return pv.Spec.AzureDisk.DataDiskURI
+	case pv.Spec.AWSElasticBlockStore != nil:
+		return pv.Spec.AWSElasticBlockStore.VolumeID
+	case pv.Spec.VsphereVolume != nil:
+		return pv.Spec.VsphereVolume.VolumePath
+	case pv.Spec.CSI != nil:
+		return pv.Spec.CSI.VolumeHandle
+	}
+	return ""
+}
+
+// getVolumeType returns the type of the PV's volume source, as used in metrics.
+func getVolumeType(pv *corev1.PersistentVolume) string {
+	switch {
+	case pv.Spec.GCEPersistentDisk != nil:
+		return "gce-pd"
+	case pv.Spec.AzureDisk != nil:
+		return "azure-disk"
+	case pv.Spec.AWSElasticBlockStore != nil:
+		return "aws-ebs"
+	case pv.Spec.VsphereVolume != nil:
+		return "vsphere-volume"
+	case isSupportedCSIVolume(pv):
+		return "csi:" + pv.Spec.CSI.Driver
+	case pv.Spec.CSI != nil:
+		return "csi"
 	}
-	return false
+	return "other"
 }
@@ -1,24 +1,52 @@
 package admission
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
 	kubescheme "k8s.io/client-go/kubernetes/scheme"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	cloudprovider "k8s.io/cloud-provider"
 	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/cloud-pv-admission-labeler/auditlog"
+	"sigs.k8s.io/cloud-pv-admission-labeler/labeler"
+	"sigs.k8s.io/cloud-pv-admission-labeler/labeler/inference"
+	"sigs.k8s.io/cloud-pv-admission-labeler/metrics"
 )
 
 type fakePVLabeler struct {
 	labels map[string]string
 	err    error
+	delay  time.Duration
+	calls  int
+	dryRun bool
 }
 
 func (f *fakePVLabeler) GetLabelsForVolume(ctx context.Context, pv *corev1.PersistentVolume) (map[string]string, error) {
+	f.calls++
+	f.dryRun = labeler.IsDryRun(ctx)
+	time.Sleep(f.delay)
 	return f.labels, f.err
 }
 
@@ -84,6 +112,56 @@ func Test_getVolumeLabels(t *testing.T) {
 			},
 			expectedErr: nil,
 		},
+		{
+			name: "CSI PV region/zone labels from cloud provider",
+			pv: &corev1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "gcepd",
+					Namespace: "myns",
+				},
+				Spec: corev1.PersistentVolumeSpec{
+					PersistentVolumeSource: corev1.PersistentVolumeSource{
+						CSI: &corev1.CSIPersistentVolumeSource{
+							Driver:       "pd.csi.storage.gke.io",
+							VolumeHandle: "projects/myproject/zones/zone1/disks/123",
+						},
+					},
+				},
+			},
+			providerLabels: map[string]string{
+				corev1.LabelTopologyZone:   "zone1",
+				corev1.LabelTopologyRegion: "region1",
+			},
+			expectedLabels: map[string]string{
+				corev1.LabelTopologyZone:   "zone1",
+				corev1.LabelTopologyRegion: "region1",
+				"topology.gke.io/zone":     "zone1",
+			},
+			expectedErr: nil,
+		},
+		{
+			name: "CSI PV from unsupported driver",
+			pv: &corev1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "nfs",
+					Namespace: "myns",
+				},
+				Spec: corev1.PersistentVolumeSpec{
+					PersistentVolumeSource: corev1.PersistentVolumeSource{
+						CSI: &corev1.CSIPersistentVolumeSource{
+							Driver:       "nfs.csi.k8s.io",
+							VolumeHandle: "server/share",
+						},
+					},
+				},
+			},
+			providerLabels: map[string]string{
+				corev1.LabelTopologyZone:   "zone1",
+				corev1.LabelTopologyRegion: "region1",
+			},
+			expectedLabels: nil,
+			expectedErr:    nil,
+		},
 		{
 			name: "PV not of type GCE, AWS, Azure or vSphere",
 			pv: &corev1.PersistentVolume{
@@ -119,8 +197,8 @@ func Test_getVolumeLabels(t *testing.T) {
 				klog.Fatalf("error adding core Kubernetes types to scheme: %v", err)
 			}
 
-			admission := NewPVLabelAdmission("gce", scheme, pvLabeler)
-			labels, err := admission.getVolumeLabels(testcase.pv)
+			admission := NewPVLabelAdmission("gce", scheme, pvLabeler, Options{})
+			labels, _, err := admission.getVolumeLabels(context.Background(), testcase.pv)
 			if err != testcase.expectedErr {
 				t.Errorf("unexpected error: %v", err)
 			}
@@ -134,6 +212,44 @@ func Test_getVolumeLabels(t *testing.T) {
 	}
 }
 
+func Test_getVolumeLabelsTimeout(t *testing.T) {
+	pvLabeler := &fakePVLabeler{
+		labels: map[string]string{
+			corev1.LabelTopologyZone:   "zone1",
+			corev1.LabelTopologyRegion: "region1",
+		},
+		delay: time.Second,
+	}
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "gcepd",
+		},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				GCEPersistentDisk: &corev1.GCEPersistentDiskVolumeSource{
+					PDName: "123",
+				},
+			},
+		},
+	}
+
+	admission := NewPVLabelAdmission("gce", runtime.NewScheme(), pvLabeler, Options{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	labels, _, err := admission.getVolumeLabels(ctx, pv)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded error, got: %v", err)
+	}
+	if labels != nil {
+		t.Errorf("unexpected labels: %v", labels)
+	}
+	if elapsed := time.Since(start); elapsed >= pvLabeler.delay {
+		t.Errorf("getVolumeLabels waited for the cloud provider for %v", elapsed)
+	}
+}
+
 func Test_mutatePV(t *testing.T) {
 	testcases := []struct {
 		name        string
@@ -296,11 +412,6 @@ func Test_mutatePV(t *testing.T) {
 							PDName: "123",
 						},
 					},
-					NodeAffinity: &corev1.VolumeNodeAffinity{
-						Required: &corev1.NodeSelector{
-							NodeSelectorTerms: make([]corev1.NodeSelectorTerm, 1),
-						},
-					},
 				},
 			},
 			expectedErr: nil,
@@ -313,10 +424,10 @@ func Test_mutatePV(t *testing.T) {
 			if err := kubescheme.AddToScheme(scheme); err != nil {
 				klog.Fatalf("error adding core Kubernetes types to scheme: %v", err)
 			}
-			admission := NewPVLabelAdmission("gce", scheme, nil)
+			admission := NewPVLabelAdmission("gce", scheme, nil, Options{})
 
 			pv := testcase.pv.DeepCopy()
-			err := admission.mutatePV(pv, testcase.labels)
+			_, err := admission.mutatePV(pv, testcase.labels)
 			if err != testcase.expectedErr {
 				t.Errorf("unexpected error: %v", err)
 			}
@@ -346,3 +457,1386 @@ func sortMatchExpressions(pv *corev1.PersistentVolume) {
 
 	pv.Spec.NodeAffinity.Required.NodeSelectorTerms[0].MatchExpressions = match
 }
+
+func Test_Admit(t *testing.T) {
+	gcePV := &corev1.PersistentVolume{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "PersistentVolume",
+			APIVersion: "v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "gcepd",
+		},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				GCEPersistentDisk: &corev1.GCEPersistentDiskVolumeSource{
+					PDName: "123",
+				},
+			},
+		},
+	}
+
+	pinnedGCEPV := gcePV.DeepCopy()
+	pinnedGCEPV.Spec.NodeAffinity = &corev1.VolumeNodeAffinity{
+		Required: &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+				MatchExpressions: []corev1.NodeSelectorRequirement{{
+					Key:      corev1.LabelTopologyZone,
+					Operator: corev1.NodeSelectorOpIn,
+					Values:   []string{"zone2"},
+				}},
+			}},
+		},
+	}
+
+	labeledGCEPV := gcePV.DeepCopy()
+	labeledGCEPV.Labels = map[string]string{corev1.LabelTopologyZone: "zone1"}
+	labeledGCEPV.Finalizers = []string{"kubernetes.io/pv-protection"}
+	labeledGCEPV.Spec.NodeAffinity = &corev1.VolumeNodeAffinity{
+		Required: &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+				MatchExpressions: []corev1.NodeSelectorRequirement{{
+					Key:      corev1.LabelTopologyZone,
+					Operator: corev1.NodeSelectorOpIn,
+					Values:   []string{"zone1"},
+				}},
+			}},
+		},
+	}
+	relabeledGCEPV := labeledGCEPV.DeepCopy()
+	relabeledGCEPV.Labels = map[string]string{"example.com/team": "storage"}
+	finalizedGCEPV := labeledGCEPV.DeepCopy()
+	finalizedGCEPV.Finalizers = nil
+	movedGCEPV := labeledGCEPV.DeepCopy()
+	movedGCEPV.Spec.GCEPersistentDisk.PDName = "456"
+	pendingGCEPV := gcePV.DeepCopy()
+	pendingGCEPV.Annotations = map[string]string{AnnPendingLabels: "true"}
+
+	testcases := []struct {
+		name             string
+		body             []byte
+		providerLabels   map[string]string
+		providerErr      error
+		failurePolicy    FailurePolicy
+		expectedAllowed  bool
+		expectedPatch    bool
+		expectedNoLookup bool
+		expectedWarning  string
+		expectedCode     int32
+		expectedMessage  string
+	}{
+		{
+			name: "PV labeled from cloud provider",
+			body: admissionReviewBody(t, "PersistentVolume", gcePV),
+			providerLabels: map[string]string{
+				corev1.LabelTopologyZone:   "zone1",
+				corev1.LabelTopologyRegion: "region1",
+			},
+			expectedAllowed: true,
+			expectedPatch:   true,
+		},
+		{
+			name: "conflicting node affinity",
+			body: admissionReviewBody(t, "PersistentVolume", pinnedGCEPV),
+			providerLabels: map[string]string{
+				corev1.LabelTopologyZone: "zone1",
+			},
+			expectedAllowed: true,
+			expectedPatch:   true,
+			expectedWarning: "no cloud provider requirements were added",
+		},
+		{
+			name:            "cloud provider error",
+			body:            admissionReviewBody(t, "PersistentVolume", gcePV),
+			providerErr:     errors.New("disk 123 not found"),
+			expectedAllowed: false,
+			expectedCode:    http.StatusForbidden,
+			expectedMessage: "disk 123 not found",
+		},
+		{
+			name:            "cloud provider error with fail-open policy",
+			body:            admissionReviewBody(t, "PersistentVolume", gcePV),
+			providerErr:     errors.New("service unavailable"),
+			failurePolicy:   FailurePolicyOpen,
+			expectedAllowed: true,
+			expectedPatch:   true,
+			expectedWarning: "admitted without topology labels",
+		},
+		{
+			name:             "update of labeled PV",
+			body:             updateAdmissionReviewBody(t, labeledGCEPV, finalizedGCEPV),
+			providerErr:      errors.New("disk 123 not found"),
+			expectedAllowed:  true,
+			expectedNoLookup: true,
+		},
+		{
+			name:             "update removing topology labels",
+			body:             updateAdmissionReviewBody(t, labeledGCEPV, relabeledGCEPV),
+			expectedAllowed:  true,
+			expectedPatch:    true,
+			expectedNoLookup: true,
+		},
+		{
+			name: "update changing volume source",
+			body: updateAdmissionReviewBody(t, labeledGCEPV, movedGCEPV),
+			providerLabels: map[string]string{
+				corev1.LabelTopologyZone: "zone2",
+			},
+			expectedAllowed: true,
+			expectedPatch:   true,
+		},
+		{
+			name: "update of pending PV",
+			body: updateAdmissionReviewBody(t, pendingGCEPV, pendingGCEPV),
+			providerLabels: map[string]string{
+				corev1.LabelTopologyZone: "zone1",
+			},
+			expectedAllowed: true,
+			expectedPatch:   true,
+		},
+		{
+			name:            "update with cloud provider error",
+			body:            updateAdmissionReviewBody(t, pendingGCEPV, pendingGCEPV),
+			providerErr:     errors.New("disk 123 not found"),
+			expectedAllowed: true,
+			expectedWarning: "not labeled",
+		},
+		{
+			name:            "unsupported kind",
+			body:            admissionReviewBody(t, "PersistentVolumeClaim", &corev1.PersistentVolumeClaim{}),
+			expectedAllowed: false,
+			expectedCode:    http.StatusBadRequest,
+			expectedMessage: "unsupported kind PersistentVolumeClaim",
+		},
+		{
+			name:            "invalid request body",
+			body:            []byte("not json"),
+			expectedAllowed: false,
+			expectedCode:    http.StatusBadRequest,
+			expectedMessage: "failed to decode request body",
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			pvLabeler := &fakePVLabeler{
+				labels: testcase.providerLabels,
+				err:    testcase.providerErr,
+			}
+			admission := NewPVLabelAdmission("gce", newTestScheme(t), pvLabeler, Options{
+				FailurePolicy: testcase.failurePolicy,
+			})
+
+			rec := httptest.NewRecorder()
+			admission.Admit(rec, httptest.NewRequest("POST", "/admit", bytes.NewReader(testcase.body)))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("unexpected HTTP status %d", rec.Code)
+			}
+			review := &admissionv1.AdmissionReview{}
+			if err := json.Unmarshal(rec.Body.Bytes(), review); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			resp := review.Response
+
+			if resp.Allowed != testcase.expectedAllowed {
+				t.Errorf("expected allowed %v, got %v", testcase.expectedAllowed, resp.Allowed)
+			}
+			if (len(resp.Patch) > 0) != testcase.expectedPatch {
+				t.Errorf("unexpected patch: %s", resp.Patch)
+			}
+			if testcase.expectedWarning != "" && (len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], testcase.expectedWarning)) {
+				t.Errorf("expected warning to contain %q, got %v", testcase.expectedWarning, resp.Warnings)
+			}
+			if testcase.expectedNoLookup && pvLabeler.calls > 0 {
+				t.Errorf("expected no cloud provider lookup, got %d", pvLabeler.calls)
+			}
+			if testcase.expectedAllowed {
+				return
+			}
+			if resp.Result == nil {
+				t.Fatal("expected status in denied response")
+			}
+			if resp.Result.Code != testcase.expectedCode {
+				t.Errorf("expected code %d, got %d", testcase.expectedCode, resp.Result.Code)
+			}
+			if !strings.Contains(resp.Result.Message, testcase.expectedMessage) {
+				t.Errorf("expected message to contain %q, got %q", testcase.expectedMessage, resp.Result.Message)
+			}
+		})
+	}
+}
+
+func Test_AdmitWithoutLabels(t *testing.T) {
+	nfsSource := corev1.PersistentVolumeSource{
+		NFS: &corev1.NFSVolumeSource{Server: "nfs.example.com", Path: "/exports/123"},
+	}
+	gceSource := corev1.PersistentVolumeSource{
+		GCEPersistentDisk: &corev1.GCEPersistentDiskVolumeSource{PDName: "123"},
+	}
+
+	testcases := []struct {
+		name       string
+		pvLabelers map[string]cloudprovider.PVLabeler
+		source     corev1.PersistentVolumeSource
+	}{
+		{
+			name:       "external labeler returning no labels",
+			pvLabelers: map[string]cloudprovider.PVLabeler{ExternalProvider: &fakePVLabeler{labels: map[string]string{}}},
+			source:     nfsSource,
+		},
+		{
+			name:       "volume of unconfigured cloud provider",
+			pvLabelers: map[string]cloudprovider.PVLabeler{"aws": &fakePVLabeler{labels: map[string]string{corev1.LabelTopologyZone: "us-east-1a"}}},
+			source:     gceSource,
+		},
+		{
+			name:       "cloud provider returning no labels",
+			pvLabelers: map[string]cloudprovider.PVLabeler{"gce": &fakePVLabeler{}},
+			source:     gceSource,
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			pv := &corev1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: "pv"},
+				Spec:       corev1.PersistentVolumeSpec{PersistentVolumeSource: testcase.source},
+			}
+			admission := NewMultiProviderPVLabelAdmission(newTestScheme(t), testcase.pvLabelers, Options{})
+
+			rec := httptest.NewRecorder()
+			admission.Admit(rec, httptest.NewRequest("POST", "/admit", bytes.NewReader(admissionReviewBody(t, "PersistentVolume", pv))))
+			review := &admissionv1.AdmissionReview{}
+			if err := json.Unmarshal(rec.Body.Bytes(), review); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if !review.Response.Allowed {
+				t.Errorf("expected PV to be allowed, got %v", review.Response.Result)
+			}
+			// An empty node selector term would match no node
+			if len(review.Response.Patch) > 0 {
+				t.Errorf("unexpected patch: %s", review.Response.Patch)
+			}
+
+			labeled, _, err := admission.Label(context.Background(), pv)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if labeled.Spec.NodeAffinity != nil {
+				t.Errorf("unexpected node affinity: %v", labeled.Spec.NodeAffinity)
+			}
+		})
+	}
+}
+
+func Test_AdmitUpdateLabelPolicy(t *testing.T) {
+	oldPV := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "gcepd",
+			Labels: map[string]string{
+				corev1.LabelFailureDomainBetaZone:   "zone1",
+				corev1.LabelFailureDomainBetaRegion: "region1",
+			},
+		},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				GCEPersistentDisk: &corev1.GCEPersistentDiskVolumeSource{PDName: "123"},
+			},
+		},
+	}
+	pv := oldPV.DeepCopy()
+	pv.Finalizers = []string{"kubernetes.io/pv-protection"}
+
+	pvLabeler := &fakePVLabeler{err: errors.New("disk 123 not found")}
+	admission := NewPVLabelAdmission("gce", newTestScheme(t), pvLabeler, Options{
+		LabelPolicy:     LabelPolicyGA,
+		StripBetaLabels: true,
+	})
+
+	review := &admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(updateAdmissionReviewBody(t, oldPV, pv), review); err != nil {
+		t.Fatalf("failed to decode admission review: %v", err)
+	}
+	resp := admission.review(context.Background(), review.Request)
+	if !resp.Allowed {
+		t.Fatalf("expected update to be allowed, got %v", resp.Result)
+	}
+	if pvLabeler.calls > 0 {
+		t.Errorf("expected no cloud provider lookup, got %d", pvLabeler.calls)
+	}
+
+	// The preserved beta labels are replaced by GA labels and node affinity
+	var patch []map[string]interface{}
+	if err := json.Unmarshal(resp.Patch, &patch); err != nil {
+		t.Fatalf("failed to decode patch %s: %v", resp.Patch, err)
+	}
+	expectedPaths := []string{
+		"/metadata/labels/failure-domain.beta.kubernetes.io~1region",
+		"/metadata/labels/failure-domain.beta.kubernetes.io~1zone",
+		"/metadata/labels/topology.kubernetes.io~1region",
+		"/metadata/labels/topology.kubernetes.io~1zone",
+		"/spec/nodeAffinity",
+	}
+	var paths []string
+	for _, operation := range patch {
+		paths = append(paths, operation["path"].(string))
+	}
+	sort.Strings(paths)
+	if !reflect.DeepEqual(paths, expectedPaths) {
+		t.Logf("actual patch: %s", resp.Patch)
+		t.Logf("expected paths: %v", expectedPaths)
+		t.Error("unexpected patch")
+	}
+	if !strings.Contains(string(resp.Patch), `"key":"topology.kubernetes.io/zone"`) || strings.Contains(string(resp.Patch), `"key":"failure-domain.beta`) {
+		t.Errorf("expected node affinity on GA labels only, got patch %s", resp.Patch)
+	}
+}
+
+func Test_AdmitDryRun(t *testing.T) {
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "gcepd"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				GCEPersistentDisk: &corev1.GCEPersistentDiskVolumeSource{PDName: "123"},
+			},
+		},
+	}
+
+	var patches [][]byte
+	for _, dryRun := range []bool{false, true} {
+		review := &admissionv1.AdmissionReview{}
+		if err := json.Unmarshal(admissionReviewBody(t, "PersistentVolume", pv), review); err != nil {
+			t.Fatalf("failed to decode admission review: %v", err)
+		}
+		review.Request.DryRun = &dryRun
+		body, err := json.Marshal(review)
+		if err != nil {
+			t.Fatalf("failed to encode admission review: %v", err)
+		}
+
+		pvLabeler := &fakePVLabeler{labels: map[string]string{corev1.LabelTopologyZone: "zone1"}}
+		admission := NewPVLabelAdmission("gce", newTestScheme(t), pvLabeler, Options{})
+		rec := httptest.NewRecorder()
+		admission.Admit(rec, httptest.NewRequest("POST", "/admit", bytes.NewReader(body)))
+
+		if pvLabeler.dryRun != dryRun {
+			t.Errorf("expected cloud provider lookup with dry-run %v, got %v", dryRun, pvLabeler.dryRun)
+		}
+		resp := &admissionv1.AdmissionReview{}
+		if err := json.Unmarshal(rec.Body.Bytes(), resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		patches = append(patches, resp.Response.Patch)
+	}
+
+	if len(patches[0]) == 0 || !bytes.Equal(patches[0], patches[1]) {
+		t.Logf("actual patch: %s", patches[1])
+		t.Logf("expected patch: %s", patches[0])
+		t.Error("expected the same patch for dry-run requests")
+	}
+}
+
+func Test_AdmitAuditLog(t *testing.T) {
+	zoneLabels := map[string]string{corev1.LabelTopologyZone: "zone1"}
+	newPV := func(labels map[string]string, annotations map[string]string) *corev1.PersistentVolume {
+		return &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "gcepd", Labels: labels, Annotations: annotations},
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeSource: corev1.PersistentVolumeSource{
+					GCEPersistentDisk: &corev1.GCEPersistentDiskVolumeSource{PDName: "123"},
+				},
+			},
+		}
+	}
+
+	testcases := []struct {
+		name           string
+		pv             *corev1.PersistentVolume
+		providerErr    error
+		dryRun         bool
+		expectedRecord auditlog.Record
+	}{
+		{
+			name: "labeled from cloud provider",
+			pv:   newPV(nil, nil),
+			expectedRecord: auditlog.Record{
+				LabelSource:          auditlog.LabelSourceLookup,
+				Labels:               zoneLabels,
+				NodeAffinity:         auditlog.NodeAffinityAdded,
+				NodeAffinityStrategy: string(NodeAffinityStrategySkip),
+				Allowed:              true,
+				Outcome:              metrics.OutcomeLabeled,
+				Reason:               "patched",
+			},
+		},
+		{
+			name: "trusted labels of provisioned PV",
+			pv: newPV(map[string]string{corev1.LabelTopologyZone: "zone2", corev1.LabelTopologyRegion: "region2"},
+				map[string]string{"pv.kubernetes.io/provisioned-by": "kubernetes.io/gce-pd"}),
+			expectedRecord: auditlog.Record{
+				LabelSource:          auditlog.LabelSourceExisting,
+				Labels:               map[string]string{corev1.LabelTopologyZone: "zone2", corev1.LabelTopologyRegion: "region2"},
+				NodeAffinity:         auditlog.NodeAffinityAdded,
+				NodeAffinityStrategy: string(NodeAffinityStrategySkip),
+				Allowed:              true,
+				Outcome:              metrics.OutcomeLabeled,
+				Reason:               "patched",
+			},
+		},
+		{
+			name:        "cloud provider error",
+			pv:          newPV(nil, nil),
+			providerErr: errors.New("disk not found"),
+			expectedRecord: auditlog.Record{
+				Outcome: metrics.OutcomeRejected,
+				Reason:  "cloud_error",
+				Message: "error getting labels for PersistentVolume gcepd from cloud provider gce: error querying GCE PD volume 123: disk not found",
+			},
+		},
+		{
+			name:   "dry run",
+			pv:     newPV(nil, nil),
+			dryRun: true,
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			pvLabeler := &fakePVLabeler{labels: zoneLabels, err: testcase.providerErr}
+			admission := NewPVLabelAdmission("gce", newTestScheme(t), pvLabeler, Options{AuditLog: auditlog.New(&buf)})
+			body := admissionReviewBody(t, "PersistentVolume", testcase.pv)
+			if testcase.dryRun {
+				review := &admissionv1.AdmissionReview{}
+				if err := json.Unmarshal(body, review); err != nil {
+					t.Fatalf("failed to decode admission review: %v", err)
+				}
+				review.Request.DryRun = &testcase.dryRun
+				var err error
+				if body, err = json.Marshal(review); err != nil {
+					t.Fatalf("failed to encode admission review: %v", err)
+				}
+			}
+			rec := httptest.NewRecorder()
+			admission.Admit(rec, httptest.NewRequest("POST", "/admit", bytes.NewReader(body)))
+
+			if testcase.dryRun {
+				if buf.Len() > 0 {
+					t.Errorf("expected no audit record for dry-run request, got %s", buf.String())
+				}
+				return
+			}
+
+			record := auditlog.Record{}
+			if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+				t.Fatalf("failed to decode audit record %q: %v", buf.String(), err)
+			}
+			if record.Allowed && len(record.Patch) == 0 {
+				t.Error("expected patch in audit record")
+			}
+			if record.Time.IsZero() || record.LatencySeconds <= 0 {
+				t.Errorf("expected time and latency in audit record, got %v and %v", record.Time, record.LatencySeconds)
+			}
+
+			expected := testcase.expectedRecord
+			expected.Time, expected.LatencySeconds, expected.Patch = record.Time, record.LatencySeconds, record.Patch
+			expected.UID, expected.Operation, expected.PV = "test-uid", "CREATE", "gcepd"
+			expected.Volume, expected.VolumeType, expected.Provider = "123", "gce-pd", "gce"
+			if !reflect.DeepEqual(record, expected) {
+				t.Logf("actual record: %+v", record)
+				t.Logf("expected record: %+v", expected)
+				t.Error("unexpected audit record")
+			}
+		})
+	}
+}
+
+func Test_AdmitTracing(t *testing.T) {
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "gcepd"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				GCEPersistentDisk: &corev1.GCEPersistentDiskVolumeSource{PDName: "123"},
+			},
+		},
+	}
+
+	testcases := []struct {
+		name        string
+		providerErr error
+		// expectedSpans maps the name of every span to the name of its parent
+		expectedSpans map[string]string
+		// expectedErrors are the names of the spans with an error status
+		expectedErrors []string
+	}{
+		{
+			name: "labeled",
+			expectedSpans: map[string]string{
+				"PVLabelAdmission.Admit": "",
+				"decode":                 "PVLabelAdmission.Admit",
+				"getVolumeLabels":        "PVLabelAdmission.Admit",
+				"GetLabelsForVolume":     "getVolumeLabels",
+				"mutatePV":               "PVLabelAdmission.Admit",
+				"getPatchBytes":          "PVLabelAdmission.Admit",
+			},
+		},
+		{
+			name:        "cloud provider error",
+			providerErr: errors.New("disk not found"),
+			expectedSpans: map[string]string{
+				"PVLabelAdmission.Admit": "",
+				"decode":                 "PVLabelAdmission.Admit",
+				"getVolumeLabels":        "PVLabelAdmission.Admit",
+				"GetLabelsForVolume":     "getVolumeLabels",
+			},
+			expectedErrors: []string{"GetLabelsForVolume", "getVolumeLabels"},
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			exporter := tracetest.NewInMemoryExporter()
+			tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter), sdktrace.WithSampler(sdktrace.AlwaysSample()))
+			pvLabeler := &fakePVLabeler{labels: map[string]string{corev1.LabelTopologyZone: "zone1"}, err: testcase.providerErr}
+			admission := NewPVLabelAdmission("gce", newTestScheme(t), pvLabeler, Options{TracerProvider: tracerProvider})
+			rec := httptest.NewRecorder()
+			admission.Admit(rec, httptest.NewRequest("POST", "/admit", bytes.NewReader(admissionReviewBody(t, "PersistentVolume", pv))))
+
+			spans := exporter.GetSpans()
+			names := make(map[trace.SpanID]string, len(spans))
+			for _, span := range spans {
+				names[span.SpanContext.SpanID()] = span.Name
+			}
+			actualSpans := make(map[string]string, len(spans))
+			var actualErrors []string
+			for _, span := range spans {
+				actualSpans[span.Name] = names[span.Parent.SpanID()]
+				if span.Status.Code == codes.Error {
+					actualErrors = append(actualErrors, span.Name)
+				}
+			}
+			sort.Strings(actualErrors)
+
+			if !reflect.DeepEqual(actualSpans, testcase.expectedSpans) {
+				t.Logf("actual spans: %v", actualSpans)
+				t.Logf("expected spans: %v", testcase.expectedSpans)
+				t.Error("unexpected spans")
+			}
+			if !reflect.DeepEqual(actualErrors, testcase.expectedErrors) {
+				t.Errorf("expected spans with errors %v, got %v", testcase.expectedErrors, actualErrors)
+			}
+		})
+	}
+}
+
+func Test_Validate(t *testing.T) {
+	newGCEPV := func(zone string, affinityZone string) *corev1.PersistentVolume {
+		pv := &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "gcepd",
+				Labels: map[string]string{
+					corev1.LabelTopologyZone:   zone,
+					corev1.LabelTopologyRegion: "region1",
+				},
+			},
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeSource: corev1.PersistentVolumeSource{
+					GCEPersistentDisk: &corev1.GCEPersistentDiskVolumeSource{
+						PDName: "123",
+					},
+				},
+			},
+		}
+		if affinityZone != "" {
+			pv.Spec.NodeAffinity = &corev1.VolumeNodeAffinity{
+				Required: &corev1.NodeSelector{
+					NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+						MatchExpressions: []corev1.NodeSelectorRequirement{{
+							Key:      corev1.LabelTopologyZone,
+							Operator: corev1.NodeSelectorOpIn,
+							Values:   []string{affinityZone},
+						}},
+					}},
+				},
+			}
+		}
+		return pv
+	}
+	wrongAffinityPV := newGCEPV("zone1", "zone2")
+	updatedWrongAffinityPV := wrongAffinityPV.DeepCopy()
+	updatedWrongAffinityPV.Finalizers = []string{"kubernetes.io/pv-protection"}
+
+	testcases := []struct {
+		name            string
+		body            []byte
+		providerErr     error
+		failurePolicy   FailurePolicy
+		expectedAllowed bool
+		expectedWarning string
+		expectedCode    int32
+		expectedMessage string
+	}{
+		{
+			name:            "matching topology",
+			body:            admissionReviewBody(t, "PersistentVolume", newGCEPV("zone1", "zone1")),
+			expectedAllowed: true,
+		},
+		{
+			name:            "wrong zone label",
+			body:            admissionReviewBody(t, "PersistentVolume", newGCEPV("zone2", "")),
+			expectedAllowed: false,
+			expectedCode:    http.StatusUnprocessableEntity,
+			expectedMessage: `labels[topology.kubernetes.io/zone] is "zone2", cloud provider reports "zone1"`,
+		},
+		{
+			name:            "wrong node affinity",
+			body:            admissionReviewBody(t, "PersistentVolume", wrongAffinityPV),
+			expectedAllowed: false,
+			expectedCode:    http.StatusUnprocessableEntity,
+			expectedMessage: "nodeAffinity.required.nodeSelectorTerms[0][topology.kubernetes.io/zone]",
+		},
+		{
+			name:            "update not changing topology",
+			body:            updateAdmissionReviewBody(t, wrongAffinityPV, updatedWrongAffinityPV),
+			expectedAllowed: true,
+		},
+		{
+			name:            "update changing topology",
+			body:            updateAdmissionReviewBody(t, newGCEPV("zone1", ""), newGCEPV("zone2", "")),
+			expectedAllowed: false,
+			expectedCode:    http.StatusUnprocessableEntity,
+			expectedMessage: "contradicts cloud provider gce",
+		},
+		{
+			name:            "cloud provider error",
+			body:            admissionReviewBody(t, "PersistentVolume", newGCEPV("zone1", "")),
+			providerErr:     errors.New("disk 123 not found"),
+			expectedAllowed: false,
+			expectedCode:    http.StatusForbidden,
+			expectedMessage: "disk 123 not found",
+		},
+		{
+			name:            "cloud provider error with fail-open policy",
+			body:            admissionReviewBody(t, "PersistentVolume", newGCEPV("zone1", "")),
+			providerErr:     errors.New("service unavailable"),
+			failurePolicy:   FailurePolicyOpen,
+			expectedAllowed: true,
+			expectedWarning: "not validated",
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			pvLabeler := &fakePVLabeler{
+				labels: map[string]string{
+					corev1.LabelTopologyZone:   "zone1",
+					corev1.LabelTopologyRegion: "region1",
+				},
+				err: testcase.providerErr,
+			}
+			admission := NewPVLabelAdmission("gce", newTestScheme(t), pvLabeler, Options{
+				FailurePolicy: testcase.failurePolicy,
+			})
+
+			rec := httptest.NewRecorder()
+			admission.Validate(rec, httptest.NewRequest("POST", "/validate", bytes.NewReader(testcase.body)))
+
+			review := &admissionv1.AdmissionReview{}
+			if err := json.Unmarshal(rec.Body.Bytes(), review); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			resp := review.Response
+
+			if resp.Allowed != testcase.expectedAllowed {
+				t.Errorf("expected allowed %v, got %v", testcase.expectedAllowed, resp.Allowed)
+			}
+			if len(resp.Patch) > 0 {
+				t.Errorf("unexpected patch: %s", resp.Patch)
+			}
+			if testcase.expectedWarning != "" && (len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], testcase.expectedWarning)) {
+				t.Errorf("expected warning to contain %q, got %v", testcase.expectedWarning, resp.Warnings)
+			}
+			if testcase.expectedAllowed {
+				return
+			}
+			if resp.Result == nil {
+				t.Fatal("expected status in denied response")
+			}
+			if resp.Result.Code != testcase.expectedCode {
+				t.Errorf("expected code %d, got %d", testcase.expectedCode, resp.Result.Code)
+			}
+			if !strings.Contains(resp.Result.Message, testcase.expectedMessage) {
+				t.Errorf("expected message to contain %q, got %q", testcase.expectedMessage, resp.Result.Message)
+			}
+		})
+	}
+}
+
+func Test_LabelPatch(t *testing.T) {
+	newEBSPV := func(labels, annotations map[string]string) *corev1.PersistentVolume {
+		return &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "ebs",
+				Labels:      labels,
+				Annotations: annotations,
+			},
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeSource: corev1.PersistentVolumeSource{
+					AWSElasticBlockStore: &corev1.AWSElasticBlockStoreVolumeSource{
+						VolumeID: "vol-123",
+					},
+				},
+			},
+		}
+	}
+	providerLabels := map[string]string{corev1.LabelTopologyZone: "us-east-1a"}
+
+	testcases := []struct {
+		name          string
+		pv            *corev1.PersistentVolume
+		options       Options
+		expectedPatch string
+	}{
+		{
+			name:          "missing labels are added",
+			pv:            newEBSPV(nil, nil),
+			expectedPatch: `{"metadata":{"labels":{"topology.kubernetes.io/zone":"us-east-1a"}}}`,
+		},
+		{
+			name:          "pending annotation is removed",
+			pv:            newEBSPV(providerLabels, map[string]string{AnnPendingLabels: "2023-01-01T00:00:00Z"}),
+			expectedPatch: `{"metadata":{"annotations":{"cloud-pv-labeler/pending":null}}}`,
+		},
+		{
+			name: "beta labels are stripped",
+			pv: newEBSPV(map[string]string{
+				corev1.LabelTopologyZone:          "us-east-1a",
+				corev1.LabelFailureDomainBetaZone: "us-east-1a",
+			}, nil),
+			options:       Options{LabelPolicy: LabelPolicyGA, StripBetaLabels: true},
+			expectedPatch: `{"metadata":{"labels":{"failure-domain.beta.kubernetes.io/zone":null}}}`,
+		},
+		{
+			name:          "labeled PV is up to date",
+			pv:            newEBSPV(providerLabels, nil),
+			expectedPatch: "",
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			pvLabelAdmission := NewPVLabelAdmission("aws", runtime.NewScheme(), &fakePVLabeler{labels: providerLabels}, testcase.options)
+			patch, err := pvLabelAdmission.LabelPatch(context.Background(), testcase.pv)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(patch) != testcase.expectedPatch {
+				t.Logf("actual patch: %s", patch)
+				t.Logf("expected patch: %s", testcase.expectedPatch)
+				t.Error("unexpected patch")
+			}
+		})
+	}
+}
+
+func Test_LabelPatchKeepsConcurrentChanges(t *testing.T) {
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "ebs"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				AWSElasticBlockStore: &corev1.AWSElasticBlockStoreVolumeSource{VolumeID: "vol-123"},
+			},
+		},
+	}
+	pvLabelAdmission := NewPVLabelAdmission("aws", runtime.NewScheme(), &fakePVLabeler{labels: map[string]string{corev1.LabelTopologyZone: "us-east-1a"}}, Options{})
+	patch, err := pvLabelAdmission.LabelPatch(context.Background(), pv)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Another writer labels the PV after it was read
+	updated := pv.DeepCopy()
+	updated.Labels = map[string]string{"app": "db"}
+	client := fake.NewSimpleClientset(updated)
+	patched, err := client.CoreV1().PersistentVolumes().Patch(context.Background(), pv.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error patching PV: %v", err)
+	}
+	expected := map[string]string{"app": "db", corev1.LabelTopologyZone: "us-east-1a"}
+	if !reflect.DeepEqual(patched.Labels, expected) {
+		t.Errorf("expected labels %v, got %v", expected, patched.Labels)
+	}
+}
+
+func Test_IsLabeled(t *testing.T) {
+	newPV := func(labels, annotations map[string]string) *corev1.PersistentVolume {
+		return &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "ebs", Labels: labels, Annotations: annotations},
+		}
+	}
+	gaLabels := map[string]string{corev1.LabelTopologyZone: "us-east-1a", corev1.LabelTopologyRegion: "us-east-1"}
+	betaLabels := map[string]string{corev1.LabelFailureDomainBetaZone: "us-east-1a", corev1.LabelFailureDomainBetaRegion: "us-east-1"}
+
+	testcases := []struct {
+		name     string
+		pv       *corev1.PersistentVolume
+		options  Options
+		expected bool
+	}{
+		{
+			name:     "zone and region labels",
+			pv:       newPV(gaLabels, nil),
+			expected: true,
+		},
+		{
+			name:     "beta labels",
+			pv:       newPV(betaLabels, nil),
+			expected: true,
+		},
+		{
+			name:     "missing region",
+			pv:       newPV(map[string]string{corev1.LabelTopologyZone: "us-east-1a"}, nil),
+			expected: false,
+		},
+		{
+			name:     "pending annotation",
+			pv:       newPV(gaLabels, map[string]string{AnnPendingLabels: "2023-01-01T00:00:00Z"}),
+			expected: false,
+		},
+		{
+			name:     "beta labels missing GA labels of the policy",
+			pv:       newPV(betaLabels, nil),
+			options:  Options{LabelPolicy: LabelPolicyBoth},
+			expected: false,
+		},
+		{
+			name: "beta labels to strip",
+			pv: newPV(map[string]string{
+				corev1.LabelTopologyZone:          "us-east-1a",
+				corev1.LabelTopologyRegion:        "us-east-1",
+				corev1.LabelFailureDomainBetaZone: "us-east-1a",
+			}, nil),
+			options:  Options{LabelPolicy: LabelPolicyGA, StripBetaLabels: true},
+			expected: false,
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			pvLabelAdmission := NewPVLabelAdmission("aws", runtime.NewScheme(), &fakePVLabeler{}, testcase.options)
+			if actual := pvLabelAdmission.IsLabeled(testcase.pv); actual != testcase.expected {
+				t.Errorf("expected IsLabeled %v, got %v", testcase.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_LabelRegionalCSIVolume(t *testing.T) {
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "regional-pd"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					Driver:       "pd.csi.storage.gke.io",
+					VolumeHandle: "projects/p/regions/us-central1/disks/disk-1",
+					FSType:       "ext4",
+				},
+			},
+		},
+	}
+	pvLabeler := &fakePVLabeler{labels: map[string]string{
+		corev1.LabelTopologyZone:   "us-central1-a__us-central1-b",
+		corev1.LabelTopologyRegion: "us-central1",
+	}}
+	pvLabelAdmission := NewPVLabelAdmission("gce", newTestScheme(t), pvLabeler, Options{})
+
+	labeled, _, err := pvLabelAdmission.Label(context.Background(), pv)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedRequirements := []corev1.NodeSelectorRequirement{
+		{Key: "topology.gke.io/zone", Operator: corev1.NodeSelectorOpIn, Values: []string{"us-central1-a", "us-central1-b"}},
+		{Key: corev1.LabelTopologyRegion, Operator: corev1.NodeSelectorOpIn, Values: []string{"us-central1"}},
+		{Key: corev1.LabelTopologyZone, Operator: corev1.NodeSelectorOpIn, Values: []string{"us-central1-a", "us-central1-b"}},
+	}
+	sortMatchExpressions(labeled)
+	requirements := labeled.Spec.NodeAffinity.Required.NodeSelectorTerms[0].MatchExpressions
+	if !reflect.DeepEqual(requirements, expectedRequirements) {
+		t.Logf("actual requirements: %v", requirements)
+		t.Logf("expected requirements: %v", expectedRequirements)
+		t.Error("unexpected node affinity")
+	}
+
+	// The regional PV is not denied by the validating webhook
+	rec := httptest.NewRecorder()
+	pvLabelAdmission.Validate(rec, httptest.NewRequest("POST", "/validate", bytes.NewReader(admissionReviewBody(t, "PersistentVolume", labeled))))
+	review := &admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(rec.Body.Bytes(), review); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if !review.Response.Allowed {
+		t.Errorf("expected regional PV to be allowed, got %v", review.Response.Result)
+	}
+}
+
+func Test_CloudLabels(t *testing.T) {
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "ebs",
+			Labels: map[string]string{
+				corev1.LabelTopologyZone:   "us-east-1b",
+				corev1.LabelTopologyRegion: "us-east-1",
+			},
+			Annotations: map[string]string{"pv.kubernetes.io/provisioned-by": "kubernetes.io/aws-ebs"},
+		},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				AWSElasticBlockStore: &corev1.AWSElasticBlockStoreVolumeSource{
+					VolumeID: "vol-123",
+				},
+			},
+		},
+	}
+	providerLabels := map[string]string{
+		corev1.LabelTopologyZone:   "us-east-1a",
+		corev1.LabelTopologyRegion: "us-east-1",
+	}
+	pvLabelAdmission := NewPVLabelAdmission("aws", runtime.NewScheme(), &fakePVLabeler{labels: providerLabels}, Options{})
+
+	// The labels of dynamically provisioned PVs are trusted by the webhook...
+	labels, _, err := pvLabelAdmission.getVolumeLabels(context.Background(), pv)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(labels, pv.Labels) {
+		t.Errorf("expected existing labels %v, got %v", pv.Labels, labels)
+	}
+
+	// ...but looked up by CloudLabels.
+	labels, err = pvLabelAdmission.CloudLabels(context.Background(), pv)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(labels, providerLabels) {
+		t.Errorf("expected provider labels %v, got %v", providerLabels, labels)
+	}
+}
+
+func newTestScheme(t *testing.T) *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	if err := kubescheme.AddToScheme(scheme); err != nil {
+		t.Fatalf("error adding core Kubernetes types to scheme: %v", err)
+	}
+	if err := admissionv1.AddToScheme(scheme); err != nil {
+		t.Fatalf("error adding admission/v1 types to scheme: %v", err)
+	}
+	return scheme
+}
+
+func admissionReviewBody(t *testing.T, kind string, obj interface{}) []byte {
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatalf("failed to encode object: %v", err)
+	}
+
+	review := &admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "AdmissionReview",
+			APIVersion: "admission.k8s.io/v1",
+		},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "test-uid",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: kind},
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatalf("failed to encode admission review: %v", err)
+	}
+	return body
+}
+
+func updateAdmissionReviewBody(t *testing.T, oldObj, obj interface{}) []byte {
+	body := admissionReviewBody(t, "PersistentVolume", obj)
+	review := &admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(body, review); err != nil {
+		t.Fatalf("failed to decode admission review: %v", err)
+	}
+
+	raw, err := json.Marshal(oldObj)
+	if err != nil {
+		t.Fatalf("failed to encode object: %v", err)
+	}
+	review.Request.Operation = admissionv1.Update
+	review.Request.OldObject = runtime.RawExtension{Raw: raw}
+
+	body, err = json.Marshal(review)
+	if err != nil {
+		t.Fatalf("failed to encode admission review: %v", err)
+	}
+	return body
+}
+
+func Test_MultiProvider(t *testing.T) {
+	awsLabels := map[string]string{corev1.LabelTopologyZone: "us-east-1a"}
+	vsphereLabels := map[string]string{corev1.LabelTopologyZone: "rack1"}
+	externalLabels := map[string]string{corev1.LabelTopologyZone: "row1"}
+	pvLabelers := map[string]cloudprovider.PVLabeler{
+		"aws":     &fakePVLabeler{labels: awsLabels},
+		"vsphere": &fakePVLabeler{labels: vsphereLabels},
+	}
+	pvLabelAdmission := NewMultiProviderPVLabelAdmission(runtime.NewScheme(), pvLabelers, Options{})
+	pvLabelers[ExternalProvider] = &fakePVLabeler{labels: externalLabels}
+	externalPVLabelAdmission := NewMultiProviderPVLabelAdmission(runtime.NewScheme(), pvLabelers, Options{})
+
+	testcases := []struct {
+		name                   string
+		source                 corev1.PersistentVolumeSource
+		expectedLabels         map[string]string
+		expectedExternalLabels map[string]string
+	}{
+		{
+			name: "AWS EBS volume",
+			source: corev1.PersistentVolumeSource{
+				AWSElasticBlockStore: &corev1.AWSElasticBlockStoreVolumeSource{VolumeID: "vol-123"},
+			},
+			expectedLabels:         awsLabels,
+			expectedExternalLabels: awsLabels,
+		},
+		{
+			name: "vSphere volume",
+			source: corev1.PersistentVolumeSource{
+				VsphereVolume: &corev1.VsphereVirtualDiskVolumeSource{VolumePath: "[datastore1] volumes/123.vmdk"},
+			},
+			expectedLabels:         vsphereLabels,
+			expectedExternalLabels: vsphereLabels,
+		},
+		{
+			name: "AWS EBS CSI volume",
+			source: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: "ebs.csi.aws.com", VolumeHandle: "vol-123"},
+			},
+			expectedLabels: map[string]string{
+				corev1.LabelTopologyZone:        "us-east-1a",
+				"topology.ebs.csi.aws.com/zone": "us-east-1a",
+			},
+			expectedExternalLabels: map[string]string{
+				corev1.LabelTopologyZone:        "us-east-1a",
+				"topology.ebs.csi.aws.com/zone": "us-east-1a",
+			},
+		},
+		{
+			name: "volume of unconfigured cloud provider",
+			source: corev1.PersistentVolumeSource{
+				GCEPersistentDisk: &corev1.GCEPersistentDiskVolumeSource{PDName: "123"},
+			},
+			expectedExternalLabels: externalLabels,
+		},
+		{
+			name: "CSI volume of another storage platform",
+			source: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: "storage.example.com", VolumeHandle: "123"},
+			},
+			expectedExternalLabels: externalLabels,
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			pv := &corev1.PersistentVolume{Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: testcase.source}}
+			labels, err := pvLabelAdmission.CloudLabels(context.Background(), pv)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(labels, testcase.expectedLabels) {
+				t.Logf("actual labels: %v", labels)
+				t.Logf("expected labels: %v", testcase.expectedLabels)
+				t.Error("unexpected labels")
+			}
+
+			// PVs of cloud providers that are not configured are admitted unchanged
+			raw, err := json.Marshal(pv)
+			if err != nil {
+				t.Fatalf("failed to encode PersistentVolume: %v", err)
+			}
+			resp := pvLabelAdmission.review(context.Background(), &admissionv1.AdmissionRequest{
+				UID:       "test-uid",
+				Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "PersistentVolume"},
+				Operation: admissionv1.Create,
+				Object:    runtime.RawExtension{Raw: raw},
+			})
+			if !resp.Allowed {
+				t.Errorf("expected PV to be allowed, got %v", resp.Result)
+			}
+			if expectedPatch := len(testcase.expectedLabels) > 0; (len(resp.Patch) > 0) != expectedPatch {
+				t.Errorf("expected patch %v, got %s", expectedPatch, resp.Patch)
+			}
+
+			if !externalPVLabelAdmission.CanLabel(pv) {
+				t.Fatal("expected PV to be labeled by the external labeler")
+			}
+			labels, err = externalPVLabelAdmission.CloudLabels(context.Background(), pv)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(labels, testcase.expectedExternalLabels) {
+				t.Logf("actual labels with external labeler: %v", labels)
+				t.Logf("expected labels with external labeler: %v", testcase.expectedExternalLabels)
+				t.Error("unexpected labels with external labeler")
+			}
+		})
+	}
+}
+
+func Test_StaticProvider(t *testing.T) {
+	awsLabels := map[string]string{corev1.LabelTopologyZone: "us-east-1a"}
+	staticLabels := map[string]string{corev1.LabelTopologyZone: "zone-a"}
+	pvLabelAdmission := NewMultiProviderPVLabelAdmission(runtime.NewScheme(), map[string]cloudprovider.PVLabeler{
+		"aws":          &fakePVLabeler{labels: awsLabels},
+		StaticProvider: &fakePVLabeler{labels: staticLabels},
+	}, Options{})
+
+	testcases := []struct {
+		name           string
+		source         corev1.PersistentVolumeSource
+		expectedLabels map[string]string
+	}{
+		{
+			name: "volume of configured cloud provider",
+			source: corev1.PersistentVolumeSource{
+				AWSElasticBlockStore: &corev1.AWSElasticBlockStoreVolumeSource{VolumeID: "vol-123"},
+			},
+			expectedLabels: awsLabels,
+		},
+		{
+			name: "volume of unconfigured cloud provider",
+			source: corev1.PersistentVolumeSource{
+				VsphereVolume: &corev1.VsphereVirtualDiskVolumeSource{VolumePath: "[datastore1] volumes/123.vmdk"},
+			},
+			expectedLabels: staticLabels,
+		},
+		{
+			name: "CSI volume of unconfigured cloud provider",
+			source: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: "pd.csi.storage.gke.io", VolumeHandle: "projects/p/zones/z/disks/123"},
+			},
+			expectedLabels: map[string]string{
+				corev1.LabelTopologyZone: "zone-a",
+				"topology.gke.io/zone":   "zone-a",
+			},
+		},
+		{
+			name: "other volume",
+			source: corev1.PersistentVolumeSource{
+				NFS: &corev1.NFSVolumeSource{Server: "nfs.example.com", Path: "/export"},
+			},
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			pv := &corev1.PersistentVolume{Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: testcase.source}}
+			labels, err := pvLabelAdmission.CloudLabels(context.Background(), pv)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(labels, testcase.expectedLabels) {
+				t.Logf("actual labels: %v", labels)
+				t.Logf("expected labels: %v", testcase.expectedLabels)
+				t.Error("unexpected labels")
+			}
+		})
+	}
+}
+
+func Test_LabelSource(t *testing.T) {
+	zoneLabels := map[string]string{
+		corev1.LabelTopologyZone:   "us-central1-a",
+		corev1.LabelTopologyRegion: "us-central1",
+	}
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "gcepd"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				GCEPersistentDisk: &corev1.GCEPersistentDiskVolumeSource{PDName: "123"},
+			},
+		},
+	}
+
+	testcases := []struct {
+		name           string
+		pvLabeler      cloudprovider.PVLabeler
+		expectedSource string
+	}{
+		{
+			name:      "cloud provider",
+			pvLabeler: &fakePVLabeler{labels: zoneLabels},
+		},
+		{
+			name: "first source of chain",
+			pvLabeler: labeler.NewChain(
+				labeler.Source{Name: "cloud", Labeler: &fakePVLabeler{labels: zoneLabels}},
+				labeler.Source{Name: "snapshot", Labeler: &fakePVLabeler{err: errors.New("not cached")}},
+			),
+			expectedSource: "cloud",
+		},
+		{
+			name: "fallback source of chain",
+			pvLabeler: labeler.NewChain(
+				labeler.Source{Name: "cloud", Labeler: &fakePVLabeler{err: errors.New("cloud unavailable")}},
+				labeler.Source{Name: "snapshot", Labeler: &fakePVLabeler{labels: zoneLabels}},
+			),
+			expectedSource: "snapshot",
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			pvLabelAdmission := NewPVLabelAdmission("gce", runtime.NewScheme(), testcase.pvLabeler, Options{})
+			newPV, _, err := pvLabelAdmission.Label(context.Background(), pv)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(newPV.Labels, zoneLabels) {
+				t.Errorf("expected labels %v, got %v", zoneLabels, newPV.Labels)
+			}
+			if source := newPV.Annotations[AnnLabelSource]; source != testcase.expectedSource {
+				t.Errorf("expected label source %q, got %q", testcase.expectedSource, source)
+			}
+		})
+	}
+}
+
+func Test_LabelSourcesOnlyLabel(t *testing.T) {
+	snapshotLabels := map[string]string{
+		corev1.LabelTopologyZone:   "us-central1-a",
+		corev1.LabelTopologyRegion: "us-central1",
+	}
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "gcepd", Labels: snapshotLabels},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				GCEPersistentDisk: &corev1.GCEPersistentDiskVolumeSource{PDName: "123"},
+			},
+		},
+	}
+
+	cloudLabeler := &fakePVLabeler{err: errors.New("cloud unavailable")}
+	chain := labeler.NewChain(
+		labeler.Source{Name: "cloud", Labeler: cloudLabeler},
+		labeler.Source{Name: "snapshot", Labeler: &fakePVLabeler{labels: snapshotLabels}},
+	)
+	pvLabelAdmission := NewPVLabelAdmission("gce", newTestScheme(t), cloudLabeler, Options{
+		LabelSources: map[string]cloudprovider.PVLabeler{"gce": chain},
+	})
+
+	// PVs are labeled from the fallback label source
+	newPV, _, err := pvLabelAdmission.Label(context.Background(), pv)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if source := newPV.Annotations[AnnLabelSource]; source != "snapshot" {
+		t.Errorf("expected label source %q, got %q", "snapshot", source)
+	}
+
+	// The drift audit and validation query the cloud provider itself
+	if _, err := pvLabelAdmission.CloudLabels(context.Background(), pv); err == nil {
+		t.Error("expected CloudLabels to fail while the cloud provider is unavailable")
+	}
+	rec := httptest.NewRecorder()
+	pvLabelAdmission.Validate(rec, httptest.NewRequest("POST", "/validate", bytes.NewReader(admissionReviewBody(t, "PersistentVolume", pv))))
+	review := &admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(rec.Body.Bytes(), review); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if review.Response.Allowed {
+		t.Error("expected PV not to be validated against the fallback label source")
+	}
+}
+
+func Test_InferenceProvider(t *testing.T) {
+	storageClasses := storagelisters.NewStorageClassLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}))
+	awsLabels := map[string]string{corev1.LabelTopologyZone: "us-east-1a"}
+	pvLabelAdmission := NewMultiProviderPVLabelAdmission(runtime.NewScheme(), map[string]cloudprovider.PVLabeler{
+		"aws":             &fakePVLabeler{labels: awsLabels},
+		InferenceProvider: inference.New(storageClasses),
+	}, Options{})
+
+	testcases := []struct {
+		name           string
+		source         corev1.PersistentVolumeSource
+		expectedLabels map[string]string
+		expectedSource string
+	}{
+		{
+			name: "volume of configured cloud provider",
+			source: corev1.PersistentVolumeSource{
+				AWSElasticBlockStore: &corev1.AWSElasticBlockStoreVolumeSource{VolumeID: "vol-123"},
+			},
+			expectedLabels: awsLabels,
+		},
+		{
+			name: "CSI volume handle with zone",
+			source: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: "pd.csi.storage.gke.io", VolumeHandle: "projects/p/zones/europe-west1-b/disks/disk-1"},
+			},
+			expectedLabels: map[string]string{
+				corev1.LabelTopologyZone:   "europe-west1-b",
+				corev1.LabelTopologyRegion: "europe-west1",
+				"topology.gke.io/zone":     "europe-west1-b",
+			},
+			expectedSource: inference.RuleGCEDiskPath,
+		},
+		{
+			name: "volume without inferable location",
+			source: corev1.PersistentVolumeSource{
+				GCEPersistentDisk: &corev1.GCEPersistentDiskVolumeSource{PDName: "disk-1"},
+			},
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			pv := &corev1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: "pv"},
+				Spec:       corev1.PersistentVolumeSpec{PersistentVolumeSource: testcase.source},
+			}
+			newPV, _, err := pvLabelAdmission.Label(context.Background(), pv)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(newPV.Labels) > 0 || len(testcase.expectedLabels) > 0 {
+				if !reflect.DeepEqual(newPV.Labels, testcase.expectedLabels) {
+					t.Logf("actual labels: %v", newPV.Labels)
+					t.Logf("expected labels: %v", testcase.expectedLabels)
+					t.Error("unexpected labels")
+				}
+			}
+			if source := newPV.Annotations[AnnLabelSource]; source != testcase.expectedSource {
+				t.Errorf("expected label source %q, got %q", testcase.expectedSource, source)
+			}
+
+			// PVs matching no rule are admitted without a patch
+			raw, err := json.Marshal(pv)
+			if err != nil {
+				t.Fatalf("failed to encode PersistentVolume: %v", err)
+			}
+			resp := pvLabelAdmission.review(context.Background(), &admissionv1.AdmissionRequest{
+				UID:       "test-uid",
+				Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "PersistentVolume"},
+				Operation: admissionv1.Create,
+				Object:    runtime.RawExtension{Raw: raw},
+			})
+			if !resp.Allowed {
+				t.Errorf("expected PV to be allowed, got %v", resp.Result)
+			}
+			if expectedPatch := len(testcase.expectedLabels) > 0; (len(resp.Patch) > 0) != expectedPatch {
+				t.Errorf("expected patch %v, got %s", expectedPatch, resp.Patch)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package admission
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// NodeAffinityStrategy defines how the node affinity generated from the cloud
+// labels is merged with node affinity supplied by the user on the same keys.
+type NodeAffinityStrategy string
+
+const (
+	// NodeAffinityStrategySkip adds no generated requirement if any of them
+	// conflicts with the PV's node affinity.
+	NodeAffinityStrategySkip NodeAffinityStrategy = "skip"
+	// NodeAffinityStrategyReplace replaces the conflicting expressions with
+	// the generated requirements.
+	NodeAffinityStrategyReplace NodeAffinityStrategy = "replace"
+	// NodeAffinityStrategyIntersect restricts the conflicting expressions to
+	// the values allowed by both. The PV is denied if no value is left.
+	NodeAffinityStrategyIntersect NodeAffinityStrategy = "intersect"
+	// NodeAffinityStrategyAddNonConflicting adds the generated requirements
+	// whose keys do not conflict and leaves the others out.
+	NodeAffinityStrategyAddNonConflicting NodeAffinityStrategy = "add-nonconflicting"
+)
+
+// NodeAffinityStrategies lists the supported strategies.
+var NodeAffinityStrategies = []NodeAffinityStrategy{
+	NodeAffinityStrategySkip,
+	NodeAffinityStrategyReplace,
+	NodeAffinityStrategyIntersect,
+	NodeAffinityStrategyAddNonConflicting,
+}
+
+// ErrNodeAffinityConflict is returned when the intersection of the PV's node
+// affinity and the cloud labels allows no node.
+var ErrNodeAffinityConflict = errors.New("node affinity conflicts with the cloud provider labels")
+
+// mergeNodeAffinity adds the requirements to every node selector term of the
+// PV according to the strategy. It returns warnings explaining how conflicts
+// with existing expressions were resolved.
+func mergeNodeAffinity(strategy NodeAffinityStrategy, pv *corev1.PersistentVolume, requirements []corev1.NodeSelectorRequirement) ([]string, error) {
+	terms := pv.Spec.NodeAffinity.Required.NodeSelectorTerms
+
+	// Like the in-tree admission controller, the skip strategy only detects
+	// conflicts on the exact same keys.
+	conflicts := conflictingKeys(requirements, terms, strategy != NodeAffinityStrategySkip)
+	if len(conflicts) == 0 {
+		for i := range terms {
+			terms[i].MatchExpressions = append(terms[i].MatchExpressions, requirements...)
+		}
+		return nil, nil
+	}
+	conflictList := strings.Join(sets.List(conflicts), ", ")
+
+	switch strategy {
+	case NodeAffinityStrategyReplace:
+		for i := range terms {
+			expressions := make([]corev1.NodeSelectorRequirement, 0, len(terms[i].MatchExpressions))
+			for _, expression := range terms[i].MatchExpressions {
+				if !hasRequirementOnKey(requirements, expression.Key) {
+					expressions = append(expressions, expression)
+				}
+			}
+			terms[i].MatchExpressions = append(expressions, requirements...)
+		}
+		return []string{fmt.Sprintf("node affinity on %s replaced with the cloud provider's topology", conflictList)}, nil
+
+	case NodeAffinityStrategyIntersect:
+		var kept []corev1.NodeSelectorTerm
+		for _, term := range terms {
+			if intersectTerm(&term, requirements) {
+				kept = append(kept, term)
+			}
+		}
+		if len(kept) == 0 {
+			return nil, fmt.Errorf("%w: no node can satisfy both the node affinity on %s and the cloud provider's topology", ErrNodeAffinityConflict, conflictList)
+		}
+		pv.Spec.NodeAffinity.Required.NodeSelectorTerms = kept
+
+		warnings := []string{fmt.Sprintf("node affinity on %s restricted to the values allowed by the cloud provider's topology", conflictList)}
+		if dropped := len(terms) - len(kept); dropped > 0 {
+			warnings = append(warnings, fmt.Sprintf("%d node selector terms removed because they do not allow the cloud provider's topology", dropped))
+		}
+		return warnings, nil
+
+	case NodeAffinityStrategyAddNonConflicting:
+		for i := range terms {
+			for _, requirement := range requirements {
+				if !conflicts.Has(requirement.Key) {
+					terms[i].MatchExpressions = append(terms[i].MatchExpressions, requirement)
+				}
+			}
+		}
+		return []string{fmt.Sprintf("node affinity on %s conflicts with the cloud provider's topology, only the other cloud provider requirements were added", conflictList)}, nil
+
+	default:
+		return []string{fmt.Sprintf("node affinity on %s conflicts with the cloud provider's topology, no cloud provider requirements were added", conflictList)}, nil
+	}
+}
+
+// intersectTerm replaces the expressions of the term on the requirements' keys,
+// or their GA or beta equivalents, with expressions allowing the values
+// allowed by both. It returns false if the term cannot be satisfied anymore.
+func intersectTerm(term *corev1.NodeSelectorTerm, requirements []corev1.NodeSelectorRequirement) bool {
+	expressions := make([]corev1.NodeSelectorRequirement, 0, len(term.MatchExpressions)+len(requirements))
+	for _, expression := range term.MatchExpressions {
+		if !hasRequirementOnKey(requirements, expression.Key) || !isSetOperator(expression.Operator) {
+			// Gt and Lt do not apply to topology values, keep them as is
+			expressions = append(expressions, expression)
+		}
+	}
+
+	for _, requirement := range requirements {
+		values := sets.New(requirement.Values...)
+		for _, expression := range term.MatchExpressions {
+			if !sameTopologyKey(expression.Key, requirement.Key) {
+				continue
+			}
+
+			switch expression.Operator {
+			case corev1.NodeSelectorOpIn:
+				values = values.Intersection(sets.New(expression.Values...))
+			case corev1.NodeSelectorOpNotIn:
+				values = values.Difference(sets.New(expression.Values...))
+			case corev1.NodeSelectorOpDoesNotExist:
+				values = sets.New[string]()
+			}
+		}
+		if values.Len() == 0 {
+			return false
+		}
+
+		expressions = append(expressions, corev1.NodeSelectorRequirement{
+			Key:      requirement.Key,
+			Operator: corev1.NodeSelectorOpIn,
+			Values:   sets.List(values),
+		})
+	}
+
+	term.MatchExpressions = expressions
+	return true
+}
+
+func isSetOperator(operator corev1.NodeSelectorOperator) bool {
+	switch operator {
+	case corev1.NodeSelectorOpIn, corev1.NodeSelectorOpNotIn, corev1.NodeSelectorOpExists, corev1.NodeSelectorOpDoesNotExist:
+		return true
+	}
+	return false
+}
+
+func hasRequirementOnKey(requirements []corev1.NodeSelectorRequirement, key string) bool {
+	for _, requirement := range requirements {
+		if sameTopologyKey(key, requirement.Key) {
+			return true
+		}
+	}
+	return false
+}
+
+// conflictingKeys returns the keys of the requirements that are already used
+// by expressions of any of the terms, also through their GA or beta
+// equivalent if equivalent is true.
+func conflictingKeys(requirements []corev1.NodeSelectorRequirement, terms []corev1.NodeSelectorTerm, equivalent bool) sets.Set[string] {
+	keys := sets.New[string]()
+	for _, requirement := range requirements {
+		for _, term := range terms {
+			for _, expression := range term.MatchExpressions {
+				if expression.Key == requirement.Key || (equivalent && sameTopologyKey(expression.Key, requirement.Key)) {
+					keys.Insert(requirement.Key)
+				}
+			}
+		}
+	}
+	return keys
+}
+
+// sortRequirements sorts node selector requirements by key so that the
+// generated node affinity does not depend on map iteration order.
+func sortRequirements(requirements []corev1.NodeSelectorRequirement) {
+	sort.Slice(requirements, func(i, j int) bool { return requirements[i].Key < requirements[j].Key })
+}
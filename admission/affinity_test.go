@@ -0,0 +1,137 @@
+package admission
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_mergeNodeAffinity(t *testing.T) {
+	requirements := []corev1.NodeSelectorRequirement{
+		{Key: corev1.LabelTopologyRegion, Operator: corev1.NodeSelectorOpIn, Values: []string{"region1"}},
+		{Key: corev1.LabelTopologyZone, Operator: corev1.NodeSelectorOpIn, Values: []string{"zone1", "zone2"}},
+	}
+	userZone := func(operator corev1.NodeSelectorOperator, values ...string) corev1.NodeSelectorRequirement {
+		return corev1.NodeSelectorRequirement{Key: corev1.LabelTopologyZone, Operator: operator, Values: values}
+	}
+	userRack := corev1.NodeSelectorRequirement{Key: "example.com/rack", Operator: corev1.NodeSelectorOpIn, Values: []string{"rack1"}}
+	region := requirements[0]
+	zone := requirements[1]
+
+	testcases := []struct {
+		name             string
+		strategy         NodeAffinityStrategy
+		terms            [][]corev1.NodeSelectorRequirement
+		expectedTerms    [][]corev1.NodeSelectorRequirement
+		expectedWarnings int
+		expectedErr      error
+	}{
+		{
+			name:          "no conflict",
+			strategy:      NodeAffinityStrategySkip,
+			terms:         [][]corev1.NodeSelectorRequirement{{userRack}},
+			expectedTerms: [][]corev1.NodeSelectorRequirement{{userRack, region, zone}},
+		},
+		{
+			name:             "skip",
+			strategy:         NodeAffinityStrategySkip,
+			terms:            [][]corev1.NodeSelectorRequirement{{userZone(corev1.NodeSelectorOpIn, "zone3")}},
+			expectedTerms:    [][]corev1.NodeSelectorRequirement{{userZone(corev1.NodeSelectorOpIn, "zone3")}},
+			expectedWarnings: 1,
+		},
+		{
+			name:             "replace",
+			strategy:         NodeAffinityStrategyReplace,
+			terms:            [][]corev1.NodeSelectorRequirement{{userRack, userZone(corev1.NodeSelectorOpIn, "zone3")}},
+			expectedTerms:    [][]corev1.NodeSelectorRequirement{{userRack, region, zone}},
+			expectedWarnings: 1,
+		},
+		{
+			name:             "intersect",
+			strategy:         NodeAffinityStrategyIntersect,
+			terms:            [][]corev1.NodeSelectorRequirement{{userZone(corev1.NodeSelectorOpIn, "zone2", "zone3")}},
+			expectedTerms:    [][]corev1.NodeSelectorRequirement{{region, userZone(corev1.NodeSelectorOpIn, "zone2")}},
+			expectedWarnings: 1,
+		},
+		{
+			name:     "intersect removes unsatisfiable terms",
+			strategy: NodeAffinityStrategyIntersect,
+			terms: [][]corev1.NodeSelectorRequirement{
+				{userZone(corev1.NodeSelectorOpIn, "zone3")},
+				{userZone(corev1.NodeSelectorOpNotIn, "zone2")},
+			},
+			expectedTerms:    [][]corev1.NodeSelectorRequirement{{region, userZone(corev1.NodeSelectorOpIn, "zone1")}},
+			expectedWarnings: 2,
+		},
+		{
+			name:        "intersect with empty intersection",
+			strategy:    NodeAffinityStrategyIntersect,
+			terms:       [][]corev1.NodeSelectorRequirement{{userZone(corev1.NodeSelectorOpIn, "zone3")}},
+			expectedErr: ErrNodeAffinityConflict,
+		},
+		{
+			name:     "skip only conflicts on the same keys",
+			strategy: NodeAffinityStrategySkip,
+			terms: [][]corev1.NodeSelectorRequirement{{
+				{Key: corev1.LabelFailureDomainBetaZone, Operator: corev1.NodeSelectorOpIn, Values: []string{"zone1"}},
+			}},
+			expectedTerms: [][]corev1.NodeSelectorRequirement{{
+				{Key: corev1.LabelFailureDomainBetaZone, Operator: corev1.NodeSelectorOpIn, Values: []string{"zone1"}},
+				region, zone,
+			}},
+		},
+		{
+			name:     "beta expressions conflict with ga requirements",
+			strategy: NodeAffinityStrategyReplace,
+			terms: [][]corev1.NodeSelectorRequirement{{
+				{Key: corev1.LabelFailureDomainBetaZone, Operator: corev1.NodeSelectorOpIn, Values: []string{"zone3"}},
+			}},
+			expectedTerms:    [][]corev1.NodeSelectorRequirement{{region, zone}},
+			expectedWarnings: 1,
+		},
+		{
+			name:     "add non-conflicting",
+			strategy: NodeAffinityStrategyAddNonConflicting,
+			terms:    [][]corev1.NodeSelectorRequirement{{userZone(corev1.NodeSelectorOpIn, "zone3")}, {userRack}},
+			expectedTerms: [][]corev1.NodeSelectorRequirement{
+				{userZone(corev1.NodeSelectorOpIn, "zone3"), region},
+				{userRack, region},
+			},
+			expectedWarnings: 1,
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			pv := &corev1.PersistentVolume{}
+			pv.Spec.NodeAffinity = &corev1.VolumeNodeAffinity{Required: &corev1.NodeSelector{}}
+			for _, expressions := range testcase.terms {
+				pv.Spec.NodeAffinity.Required.NodeSelectorTerms = append(pv.Spec.NodeAffinity.Required.NodeSelectorTerms,
+					corev1.NodeSelectorTerm{MatchExpressions: append([]corev1.NodeSelectorRequirement(nil), expressions...)})
+			}
+
+			warnings, err := mergeNodeAffinity(testcase.strategy, pv, requirements)
+			if !errors.Is(err, testcase.expectedErr) {
+				t.Fatalf("expected error %v, got %v", testcase.expectedErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if len(warnings) != testcase.expectedWarnings {
+				t.Errorf("expected %d warnings, got %v", testcase.expectedWarnings, warnings)
+			}
+
+			var terms [][]corev1.NodeSelectorRequirement
+			for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+				terms = append(terms, term.MatchExpressions)
+			}
+			if !reflect.DeepEqual(terms, testcase.expectedTerms) {
+				t.Logf("actual terms: %v", terms)
+				t.Logf("expected terms: %v", testcase.expectedTerms)
+				t.Error("unexpected node selector terms")
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package admission
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	csitrans "k8s.io/csi-translation-lib"
+	"k8s.io/csi-translation-lib/plugins"
+)
+
+const (
+	// vSphereCSITopologyZoneKey is the zonal topology key for the vSphere CSI driver
+	vSphereCSITopologyZoneKey = "topology.csi.vmware.com/zone"
+	// vSphereCSITopologyRegionKey is the regional topology key for the vSphere CSI driver
+	vSphereCSITopologyRegionKey = "topology.csi.vmware.com/region"
+)
+
+// csiDriverTopologyKeys maps the CSI drivers that can be labeled to the topology
+// keys published by each driver, indexed by the equivalent Kubernetes topology label.
+var csiDriverTopologyKeys = map[string]map[string]string{
+	plugins.GCEPDDriverName: {
+		corev1.LabelTopologyZone: plugins.GCEPDTopologyKey,
+	},
+	plugins.AWSEBSDriverName: {
+		corev1.LabelTopologyZone: plugins.AWSEBSTopologyKey,
+	},
+	plugins.AzureDiskDriverName: {
+		corev1.LabelTopologyZone: plugins.AzureDiskTopologyKey,
+	},
+	plugins.VSphereDriverName: {
+		corev1.LabelTopologyZone:   vSphereCSITopologyZoneKey,
+		corev1.LabelTopologyRegion: vSphereCSITopologyRegionKey,
+	},
+}
+
+// csiDriverProviders maps the CSI drivers that can be labeled to the cloud
+// provider looking up their volumes.
+var csiDriverProviders = map[string]string{
+	plugins.GCEPDDriverName:     "gce",
+	plugins.AWSEBSDriverName:    "aws",
+	plugins.AzureDiskDriverName: "azure",
+	plugins.VSphereDriverName:   "vsphere",
+}
+
+// isSupportedCSIVolume returns true if the PV is backed by a CSI driver
+// that can be translated to one of the supported in-tree volume sources.
+func isSupportedCSIVolume(pv *corev1.PersistentVolume) bool {
+	if pv.Spec.CSI == nil {
+		return false
+	}
+	_, ok := csiDriverTopologyKeys[pv.Spec.CSI.Driver]
+	return ok
+}
+
+// translateCSIPV returns a copy of the PV with its CSI volume source replaced
+// by the matching in-tree volume source so it can be passed to a PVLabeler.
+func translateCSIPV(pv *corev1.PersistentVolume) (*corev1.PersistentVolume, error) {
+	translated, err := csitrans.New().TranslateCSIPVToInTree(pv)
+	if err != nil {
+		return nil, fmt.Errorf("error translating CSI volume %s from driver %s: %v", pv.Spec.CSI.VolumeHandle, pv.Spec.CSI.Driver, err)
+	}
+
+	return translated, nil
+}
+
+// addCSITopologyLabels adds the CSI driver's own topology keys to the labels,
+// using the values of the equivalent GA or beta Kubernetes topology labels.
+func addCSITopologyLabels(driver string, labels map[string]string) map[string]string {
+	keys, ok := csiDriverTopologyKeys[driver]
+	if !ok || len(labels) == 0 {
+		return labels
+	}
+
+	csiLabels := make(map[string]string, len(labels)+len(keys))
+	for k, v := range labels {
+		csiLabels[k] = v
+	}
+
+	for k, v := range labels {
+		var csiKey string
+		switch k {
+		case corev1.LabelTopologyZone, corev1.LabelFailureDomainBetaZone:
+			csiKey = keys[corev1.LabelTopologyZone]
+		case corev1.LabelTopologyRegion, corev1.LabelFailureDomainBetaRegion:
+			csiKey = keys[corev1.LabelTopologyRegion]
+		}
+		if csiKey != "" {
+			csiLabels[csiKey] = v
+		}
+	}
+
+	return csiLabels
+}
@@ -0,0 +1,62 @@
+package admission
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_addCSITopologyLabels(t *testing.T) {
+	testcases := []struct {
+		name           string
+		driver         string
+		labels         map[string]string
+		expectedLabels map[string]string
+	}{
+		{
+			name:   "AWS EBS GA labels",
+			driver: "ebs.csi.aws.com",
+			labels: map[string]string{
+				corev1.LabelTopologyZone:   "us-east-1a",
+				corev1.LabelTopologyRegion: "us-east-1",
+			},
+			expectedLabels: map[string]string{
+				corev1.LabelTopologyZone:        "us-east-1a",
+				corev1.LabelTopologyRegion:      "us-east-1",
+				"topology.ebs.csi.aws.com/zone": "us-east-1a",
+			},
+		},
+		{
+			name:   "vSphere beta labels",
+			driver: "csi.vsphere.vmware.com",
+			labels: map[string]string{
+				corev1.LabelFailureDomainBetaZone:   "zone1",
+				corev1.LabelFailureDomainBetaRegion: "region1",
+			},
+			expectedLabels: map[string]string{
+				corev1.LabelFailureDomainBetaZone:   "zone1",
+				corev1.LabelFailureDomainBetaRegion: "region1",
+				"topology.csi.vmware.com/zone":      "zone1",
+				"topology.csi.vmware.com/region":    "region1",
+			},
+		},
+		{
+			name:           "no labels",
+			driver:         "disk.csi.azure.com",
+			labels:         nil,
+			expectedLabels: nil,
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			labels := addCSITopologyLabels(testcase.driver, testcase.labels)
+			if !reflect.DeepEqual(labels, testcase.expectedLabels) {
+				t.Logf("actual labels: %v", labels)
+				t.Logf("expected labels: %v", testcase.expectedLabels)
+				t.Error("unexpected labels from addCSITopologyLabels")
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package admission
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"sigs.k8s.io/cloud-pv-admission-labeler/labeler"
+)
+
+// Reasons of the events recorded on PVs.
+const (
+	// EventReasonLabelingFailed is recorded when the labels of a PV cannot be
+	// retrieved, whether the PV is denied or admitted without them.
+	EventReasonLabelingFailed = "LabelingFailed"
+	// EventReasonLabelsPending is recorded when a PV is admitted without labels
+	// and annotated with AnnPendingLabels.
+	EventReasonLabelsPending = "LabelsPending"
+	// EventReasonTrustedLabels is recorded when the existing labels of a
+	// dynamically provisioned PV are used instead of being looked up.
+	EventReasonTrustedLabels = "TrustedLabels"
+	// EventReasonNodeAffinityConflict is recorded when the PV's node affinity
+	// conflicts with its labels, whether the conflict was resolved according to
+	// the NodeAffinityStrategy or the PV is denied.
+	EventReasonNodeAffinityConflict = "NodeAffinityConflict"
+	// EventReasonInvalidLabels is recorded when a PV is denied because its
+	// labels cannot be turned into node affinity.
+	EventReasonInvalidLabels = "InvalidLabels"
+	// EventReasonTopologyMismatch is recorded when a PV is denied because its
+	// topology contradicts the cloud provider's.
+	EventReasonTopologyMismatch = "TopologyMismatch"
+	// EventReasonTopologyNotValidated is recorded when a PV is admitted
+	// without validation because its labels cannot be retrieved.
+	EventReasonTopologyNotValidated = "TopologyNotValidated"
+)
+
+// event records an event on the PV, unless the request is a dry run. The
+// EventRecorder sends events asynchronously and drops them when its queue is
+// full, so this never delays the admission response. Events of PVs being
+// created refer to them by name only since they have no UID yet.
+func (p *PVLabelAdmission) event(ctx context.Context, pv *corev1.PersistentVolume, eventtype, reason, messageFmt string, args ...interface{}) {
+	if p.options.EventRecorder == nil || labeler.IsDryRun(ctx) {
+		return
+	}
+	p.options.EventRecorder.Eventf(pv, eventtype, reason, messageFmt, args...)
+}
@@ -0,0 +1,131 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+
+	"sigs.k8s.io/cloud-pv-admission-labeler/labeler"
+)
+
+func Test_Events(t *testing.T) {
+	zoneLabels := map[string]string{corev1.LabelTopologyZone: "zone1"}
+	newPV := func(annotations map[string]string, labels map[string]string, affinityZone string) *corev1.PersistentVolume {
+		pv := &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "gcepd", Annotations: annotations, Labels: labels},
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeSource: corev1.PersistentVolumeSource{
+					GCEPersistentDisk: &corev1.GCEPersistentDiskVolumeSource{PDName: "123"},
+				},
+			},
+		}
+		if affinityZone != "" {
+			pv.Spec.NodeAffinity = &corev1.VolumeNodeAffinity{
+				Required: &corev1.NodeSelector{
+					NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+						MatchExpressions: []corev1.NodeSelectorRequirement{
+							{Key: corev1.LabelTopologyZone, Operator: corev1.NodeSelectorOpIn, Values: []string{affinityZone}},
+						},
+					}},
+				},
+			}
+		}
+		return pv
+	}
+
+	testcases := []struct {
+		name           string
+		pv             *corev1.PersistentVolume
+		providerErr    error
+		options        Options
+		dryRun         bool
+		expectedEvents []string
+	}{
+		{
+			name: "labeled",
+			pv:   newPV(nil, nil, ""),
+		},
+		{
+			name:           "cloud provider error",
+			pv:             newPV(nil, nil, ""),
+			providerErr:    errors.New("disk not found"),
+			expectedEvents: []string{"Warning LabelingFailed Denied: error getting labels from cloud provider gce: error querying GCE PD volume 123: disk not found"},
+		},
+		{
+			name:           "cloud provider error with failure policy open",
+			pv:             newPV(nil, nil, ""),
+			providerErr:    errors.New("disk not found"),
+			options:        Options{FailurePolicy: FailurePolicyOpen},
+			expectedEvents: []string{"Warning LabelsPending Admitted without labels, to be labeled later: error getting labels from cloud provider gce: error querying GCE PD volume 123: disk not found"},
+		},
+		{
+			name: "trusted labels of provisioned PV",
+			pv: newPV(map[string]string{"pv.kubernetes.io/provisioned-by": "kubernetes.io/gce-pd"},
+				map[string]string{corev1.LabelTopologyZone: "zone2", corev1.LabelTopologyRegion: "region2"}, ""),
+			expectedEvents: []string{"Normal TrustedLabels Labels map[topology.kubernetes.io/region:region2 topology.kubernetes.io/zone:zone2] set by the provisioner used instead of looking them up from cloud provider gce"},
+		},
+		{
+			name: "node affinity conflict skipped",
+			pv:   newPV(nil, nil, "zone2"),
+			expectedEvents: []string{"Warning NodeAffinityConflict Node affinity merged with labels map[topology.kubernetes.io/zone:zone1] according to node affinity strategy skip: " +
+				"node affinity on topology.kubernetes.io/zone conflicts with the cloud provider's topology, no cloud provider requirements were added"},
+		},
+		{
+			name:    "node affinity conflict denied",
+			pv:      newPV(nil, nil, "zone2"),
+			options: Options{NodeAffinityStrategy: NodeAffinityStrategyIntersect},
+			expectedEvents: []string{"Warning NodeAffinityConflict Denied: error adding node affinity for labels map[topology.kubernetes.io/zone:zone1]: " +
+				"node affinity conflicts with the cloud provider labels: no node can satisfy both the node affinity on topology.kubernetes.io/zone and the cloud provider's topology"},
+		},
+		{
+			name:        "dry run",
+			pv:          newPV(nil, nil, ""),
+			providerErr: errors.New("disk not found"),
+			dryRun:      true,
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			options := testcase.options
+			options.EventRecorder = recorder
+			pvLabeler := &fakePVLabeler{labels: zoneLabels, err: testcase.providerErr}
+			admission := NewPVLabelAdmission("gce", newTestScheme(t), pvLabeler, options)
+
+			raw, err := json.Marshal(testcase.pv)
+			if err != nil {
+				t.Fatalf("failed to encode PersistentVolume: %v", err)
+			}
+			ctx := context.Background()
+			if testcase.dryRun {
+				ctx = labeler.WithDryRun(ctx)
+			}
+			admission.review(ctx, &admissionv1.AdmissionRequest{
+				UID:       "test-uid",
+				Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "PersistentVolume"},
+				Operation: admissionv1.Create,
+				Object:    runtime.RawExtension{Raw: raw},
+			})
+
+			close(recorder.Events)
+			var events []string
+			for event := range recorder.Events {
+				events = append(events, event)
+			}
+			if !reflect.DeepEqual(events, testcase.expectedEvents) {
+				t.Logf("actual events: %q", events)
+				t.Logf("expected events: %q", testcase.expectedEvents)
+				t.Error("unexpected events")
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package admission
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	volumehelpers "k8s.io/cloud-provider/volume/helpers"
+)
+
+// equivalentLabels maps the GA topology labels to their beta equivalents and back.
+var equivalentLabels = map[string]string{
+	corev1.LabelTopologyZone:            corev1.LabelFailureDomainBetaZone,
+	corev1.LabelTopologyRegion:          corev1.LabelFailureDomainBetaRegion,
+	corev1.LabelFailureDomainBetaZone:   corev1.LabelTopologyZone,
+	corev1.LabelFailureDomainBetaRegion: corev1.LabelTopologyRegion,
+}
+
+// LabelPolicy defines which of the GA and beta topology labels are set on PVs.
+type LabelPolicy string
+
+const (
+	// LabelPolicyAsIs sets the topology labels returned by the cloud provider,
+	// or already on dynamically provisioned PVs.
+	LabelPolicyAsIs LabelPolicy = "as-is"
+	// LabelPolicyGA sets only the GA topology.kubernetes.io labels.
+	LabelPolicyGA LabelPolicy = "ga"
+	// LabelPolicyBeta sets only the beta failure-domain.beta.kubernetes.io labels.
+	LabelPolicyBeta LabelPolicy = "beta"
+	// LabelPolicyBoth sets both the GA and beta labels, with the same values.
+	LabelPolicyBoth LabelPolicy = "both"
+)
+
+// LabelPolicies lists the supported label policies.
+var LabelPolicies = []LabelPolicy{LabelPolicyAsIs, LabelPolicyGA, LabelPolicyBeta, LabelPolicyBoth}
+
+// betaLabels are the deprecated beta topology labels.
+var betaLabels = []string{corev1.LabelFailureDomainBetaZone, corev1.LabelFailureDomainBetaRegion}
+
+// applyLabelPolicy returns the volume labels with the GA and beta topology
+// labels set according to the policy. When the labels hold both the GA and
+// the beta label, the GA value wins so that the returned labels, and the node
+// affinity generated from them, never disagree.
+func applyLabelPolicy(policy LabelPolicy, labels map[string]string) map[string]string {
+	if policy == "" || policy == LabelPolicyAsIs || len(labels) == 0 {
+		return labels
+	}
+
+	result := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if _, ok := equivalentLabels[k]; !ok {
+			result[k] = v
+		}
+	}
+	for _, gaKey := range []string{corev1.LabelTopologyZone, corev1.LabelTopologyRegion} {
+		betaKey := equivalentLabels[gaKey]
+		value, ok := labels[gaKey]
+		if !ok {
+			value, ok = labels[betaKey]
+		}
+		if !ok {
+			continue
+		}
+
+		if policy != LabelPolicyBeta {
+			result[gaKey] = value
+		}
+		if policy != LabelPolicyGA {
+			result[betaKey] = value
+		}
+	}
+	return result
+}
+
+// stripBetaLabels removes the beta topology labels from the PV unless they
+// are part of the volume labels.
+func stripBetaLabels(pv *corev1.PersistentVolume, volumeLabels map[string]string) {
+	for _, key := range betaLabels {
+		if _, ok := volumeLabels[key]; !ok {
+			delete(pv.Labels, key)
+		}
+	}
+}
+
+// sameTopologyKey returns true if the keys are equal or equivalent GA and beta
+// topology labels.
+func sameTopologyKey(a, b string) bool {
+	return a == b || equivalentLabels[a] == b
+}
+
+// TopologyDifference is a topology label or node affinity requirement of a PV
+// that disagrees with the cloud provider.
+type TopologyDifference struct {
+	// Field is the label or node affinity requirement, e.g. "labels[topology.kubernetes.io/zone]".
+	Field string `json:"field"`
+	// Actual is the value on the PV.
+	Actual string `json:"actual"`
+	// Expected is the value returned by the cloud provider.
+	Expected string `json:"expected"`
+}
+
+// String describes the difference for use in messages.
+func (d TopologyDifference) String() string {
+	return fmt.Sprintf("%s is %q, cloud provider reports %q", d.Field, d.Actual, d.Expected)
+}
+
+// CompareTopology returns the topology labels and node affinity requirements
+// of the PV that disagree with the labels returned by the cloud provider.
+// Labels missing from the PV are not reported.
+func CompareTopology(pv *corev1.PersistentVolume, cloudLabels map[string]string) []TopologyDifference {
+	keys := make([]string, 0, len(cloudLabels))
+	for k := range cloudLabels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var differences []TopologyDifference
+	for _, key := range keys {
+		expected := cloudLabels[key]
+
+		// The GA and beta labels are equivalent, only one of them needs to be set.
+		labelKeys := []string{key}
+		if equivalent, ok := equivalentLabels[key]; ok {
+			if _, ok := cloudLabels[equivalent]; !ok {
+				labelKeys = append(labelKeys, equivalent)
+			}
+		}
+
+		for _, labelKey := range labelKeys {
+			if actual, ok := pv.Labels[labelKey]; ok && !sameValues(labelKey, actual, expected) {
+				differences = append(differences, TopologyDifference{Field: fmt.Sprintf("labels[%s]", labelKey), Actual: actual, Expected: expected})
+			}
+		}
+
+		differences = append(differences, compareNodeAffinity(pv, labelKeys, expected)...)
+	}
+
+	return differences
+}
+
+// compareNodeAffinity returns the node affinity requirements on the given keys
+// that do not allow the values expected from the cloud provider.
+func compareNodeAffinity(pv *corev1.PersistentVolume, keys []string, expected string) []TopologyDifference {
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return nil
+	}
+
+	var differences []TopologyDifference
+	for i, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		for _, req := range term.MatchExpressions {
+			if req.Operator != corev1.NodeSelectorOpIn || !contains(keys, req.Key) {
+				continue
+			}
+			if !allowsValues(req.Key, req.Values, expected) {
+				differences = append(differences, TopologyDifference{
+					Field:    fmt.Sprintf("nodeAffinity.required.nodeSelectorTerms[%d][%s]", i, req.Key),
+					Actual:   strings.Join(req.Values, ","),
+					Expected: expected,
+				})
+			}
+		}
+	}
+	return differences
+}
+
+// sameValues returns true if the label values are equal. Zone labels may list
+// several zones, in which case they are compared as sets.
+func sameValues(key, actual, expected string) bool {
+	if !isZoneLabel(key) {
+		return actual == expected
+	}
+
+	actualZones, err := volumehelpers.LabelZonesToSet(actual)
+	if err != nil {
+		return false
+	}
+	expectedZones, err := volumehelpers.LabelZonesToSet(expected)
+	if err != nil {
+		return false
+	}
+	return actualZones.Equal(expectedZones)
+}
+
+// allowsValues returns true if the requirement values include all the values
+// expected from the cloud provider.
+func allowsValues(key string, values []string, expected string) bool {
+	expectedValues := []string{expected}
+	if isZoneLabel(key) {
+		zones, err := volumehelpers.LabelZonesToSet(expected)
+		if err != nil {
+			return false
+		}
+		expectedValues = zones.List()
+	}
+
+	for _, value := range expectedValues {
+		if !contains(values, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// isZoneLabel returns true if the label is a zone label, whose value may list
+// several zones, e.g. the zones of a regional PD. The zone keys of CSI drivers
+// receive the same value as the Kubernetes zone labels.
+func isZoneLabel(key string) bool {
+	if key == corev1.LabelTopologyZone || key == corev1.LabelFailureDomainBetaZone {
+		return true
+	}
+	for _, keys := range csiDriverTopologyKeys {
+		if keys[corev1.LabelTopologyZone] == key {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
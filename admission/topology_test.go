@@ -0,0 +1,174 @@
+package admission
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTopologyPV(labels map[string]string, affinityZones ...string) *corev1.PersistentVolume {
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv", Labels: labels},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				AWSElasticBlockStore: &corev1.AWSElasticBlockStoreVolumeSource{VolumeID: "vol-123"},
+			},
+		},
+	}
+	if len(affinityZones) > 0 {
+		pv.Spec.NodeAffinity = &corev1.VolumeNodeAffinity{
+			Required: &corev1.NodeSelector{
+				NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+					MatchExpressions: []corev1.NodeSelectorRequirement{{
+						Key:      corev1.LabelTopologyZone,
+						Operator: corev1.NodeSelectorOpIn,
+						Values:   affinityZones,
+					}},
+				}},
+			},
+		}
+	}
+	return pv
+}
+
+func Test_CompareTopology(t *testing.T) {
+	cloudLabels := map[string]string{
+		corev1.LabelTopologyZone:   "us-east-1a",
+		corev1.LabelTopologyRegion: "us-east-1",
+	}
+
+	testcases := []struct {
+		name                string
+		pv                  *corev1.PersistentVolume
+		expectedDifferences []TopologyDifference
+	}{
+		{
+			name: "matching labels and node affinity",
+			pv:   newTopologyPV(cloudLabels, "us-east-1a"),
+		},
+		{
+			name: "missing labels are not drift",
+			pv:   newTopologyPV(nil),
+		},
+		{
+			name: "wrong zone label",
+			pv: newTopologyPV(map[string]string{
+				corev1.LabelTopologyZone:   "us-east-1b",
+				corev1.LabelTopologyRegion: "us-east-1",
+			}),
+			expectedDifferences: []TopologyDifference{
+				{Field: "labels[topology.kubernetes.io/zone]", Actual: "us-east-1b", Expected: "us-east-1a"},
+			},
+		},
+		{
+			name: "wrong beta region label",
+			pv: newTopologyPV(map[string]string{
+				corev1.LabelFailureDomainBetaZone:   "us-east-1a",
+				corev1.LabelFailureDomainBetaRegion: "us-west-2",
+			}),
+			expectedDifferences: []TopologyDifference{
+				{Field: "labels[failure-domain.beta.kubernetes.io/region]", Actual: "us-west-2", Expected: "us-east-1"},
+			},
+		},
+		{
+			name: "wrong node affinity",
+			pv:   newTopologyPV(cloudLabels, "us-east-1b", "us-east-1c"),
+			expectedDifferences: []TopologyDifference{
+				{Field: "nodeAffinity.required.nodeSelectorTerms[0][topology.kubernetes.io/zone]", Actual: "us-east-1b,us-east-1c", Expected: "us-east-1a"},
+			},
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			differences := CompareTopology(testcase.pv, cloudLabels)
+			if !reflect.DeepEqual(differences, testcase.expectedDifferences) {
+				t.Logf("actual differences: %+v", differences)
+				t.Logf("expected differences: %+v", testcase.expectedDifferences)
+				t.Error("unexpected differences")
+			}
+		})
+	}
+}
+
+func Test_applyLabelPolicy(t *testing.T) {
+	gaLabels := map[string]string{
+		corev1.LabelTopologyZone:   "zone1",
+		corev1.LabelTopologyRegion: "region1",
+	}
+	betaLabels := map[string]string{
+		corev1.LabelFailureDomainBetaZone:   "zone1",
+		corev1.LabelFailureDomainBetaRegion: "region1",
+	}
+	bothLabels := map[string]string{
+		corev1.LabelTopologyZone:            "zone1",
+		corev1.LabelTopologyRegion:          "region1",
+		corev1.LabelFailureDomainBetaZone:   "zone1",
+		corev1.LabelFailureDomainBetaRegion: "region1",
+	}
+
+	testcases := []struct {
+		name           string
+		policy         LabelPolicy
+		labels         map[string]string
+		expectedLabels map[string]string
+	}{
+		{
+			name:           "as-is",
+			policy:         LabelPolicyAsIs,
+			labels:         betaLabels,
+			expectedLabels: betaLabels,
+		},
+		{
+			name:           "ga from beta",
+			policy:         LabelPolicyGA,
+			labels:         betaLabels,
+			expectedLabels: gaLabels,
+		},
+		{
+			name:           "beta from ga",
+			policy:         LabelPolicyBeta,
+			labels:         gaLabels,
+			expectedLabels: betaLabels,
+		},
+		{
+			name:           "both from ga",
+			policy:         LabelPolicyBoth,
+			labels:         gaLabels,
+			expectedLabels: bothLabels,
+		},
+		{
+			name:   "both with disagreeing values uses ga",
+			policy: LabelPolicyBoth,
+			labels: map[string]string{
+				corev1.LabelTopologyZone:          "zone1",
+				corev1.LabelFailureDomainBetaZone: "zone2",
+				"topology.gke.io/zone":            "zone1",
+			},
+			expectedLabels: map[string]string{
+				corev1.LabelTopologyZone:          "zone1",
+				corev1.LabelFailureDomainBetaZone: "zone1",
+				"topology.gke.io/zone":            "zone1",
+			},
+		},
+		{
+			name:           "no labels",
+			policy:         LabelPolicyBoth,
+			labels:         nil,
+			expectedLabels: nil,
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			labels := applyLabelPolicy(testcase.policy, testcase.labels)
+			if !reflect.DeepEqual(labels, testcase.expectedLabels) {
+				t.Logf("actual labels: %v", labels)
+				t.Logf("expected labels: %v", testcase.expectedLabels)
+				t.Error("unexpected labels")
+			}
+		})
+	}
+}
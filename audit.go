@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"sigs.k8s.io/cloud-pv-admission-labeler/admission"
+	"sigs.k8s.io/cloud-pv-admission-labeler/audit"
+)
+
+const outputTable = "table"
+
+// runAudit implements the audit command: it compares the topology of the
+// PersistentVolumes in the cluster with the cloud provider and reports the
+// ones that disagree. It returns the exit code of the command.
+func runAudit(pvLabelAdmission *admission.PVLabelAdmission, args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("audit", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	output := fs.String("output", outputTable, "the report format, \"table\" or \"json\"")
+	events := fs.Bool("events", false, "record a Warning Event on every PersistentVolume whose topology disagrees with the cloud provider")
+	qps := fs.Float64("qps", 5, "the maximum number of PersistentVolumes looked up from the cloud provider per second")
+	burst := fs.Int("burst", 10, "the maximum burst of PersistentVolumes looked up from the cloud provider")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s [flags] audit [--output=table|json] [--events]\n\n", os.Args[0])
+		fmt.Fprintf(stderr, "Reports the PersistentVolumes whose topology labels or node affinity disagree with the cloud provider.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *output != outputTable && *output != "json" {
+		fmt.Fprintf(stderr, "invalid --output %q, must be %q or %q\n", *output, outputTable, "json")
+		return 2
+	}
+	if *qps <= 0 || *burst <= 0 {
+		fmt.Fprintf(stderr, "--qps and --burst must be positive\n")
+		return 2
+	}
+
+	client, err := newKubeClient()
+	if err != nil {
+		fmt.Fprintf(stderr, "error creating Kubernetes client: %v\n", err)
+		return 1
+	}
+
+	ctx := context.Background()
+	auditor := audit.NewAuditor(client, pvLabelAdmission, audit.Config{
+		QPS:   float32(*qps),
+		Burst: *burst,
+	})
+	report, err := auditor.Run(ctx)
+	if err != nil {
+		fmt.Fprintf(stderr, "error auditing PersistentVolumes: %v\n", err)
+		return 1
+	}
+
+	if *output == outputTable {
+		err = report.WriteTable(stdout)
+	} else {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "error printing report: %v\n", err)
+		return 1
+	}
+
+	if *events {
+		if err := auditor.RecordEvents(ctx, report); err != nil {
+			fmt.Fprintf(stderr, "error recording Events: %v\n", err)
+			return 1
+		}
+	}
+
+	if len(report.Results) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,171 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/cloud-pv-admission-labeler/admission"
+)
+
+// EventReasonTopologyDrift is the reason of the Events recorded on PVs whose
+// topology disagrees with the cloud provider.
+const EventReasonTopologyDrift = "TopologyDrift"
+
+// Labeler looks up the labels of a PV's volume from the cloud provider. It is
+// implemented by admission.PVLabelAdmission.
+type Labeler interface {
+	CanLabel(pv *corev1.PersistentVolume) bool
+	CloudLabels(ctx context.Context, pv *corev1.PersistentVolume) (map[string]string, error)
+}
+
+// Result is the audit result of a single PV.
+type Result struct {
+	PV          string                         `json:"pv"`
+	UID         string                         `json:"uid"`
+	Differences []admission.TopologyDifference `json:"differences,omitempty"`
+	Error       string                         `json:"error,omitempty"`
+}
+
+// Report lists the PVs that disagree with the cloud provider or could not be audited.
+type Report struct {
+	// Checked is the number of PVs looked up from the cloud provider.
+	Checked int `json:"checked"`
+	// Skipped is the number of PVs whose volume is not one the webhook labels.
+	Skipped int      `json:"skipped"`
+	Results []Result `json:"results"`
+}
+
+// Config configures the Auditor.
+type Config struct {
+	// QPS and Burst limit how many PVs are looked up from the cloud provider.
+	QPS   float32
+	Burst int
+}
+
+// Auditor compares the topology labels and node affinity of the PVs in the
+// cluster with the location of their volumes reported by the cloud provider.
+type Auditor struct {
+	client  kubernetes.Interface
+	labeler Labeler
+	limiter flowcontrol.RateLimiter
+}
+
+// NewAuditor returns an Auditor using the given client and labeler.
+func NewAuditor(client kubernetes.Interface, labeler Labeler, config Config) *Auditor {
+	return &Auditor{
+		client:  client,
+		labeler: labeler,
+		limiter: flowcontrol.NewTokenBucketRateLimiter(config.QPS, config.Burst),
+	}
+}
+
+// Run audits all the PVs in the cluster.
+func (a *Auditor) Run(ctx context.Context) (*Report, error) {
+	pvList, err := a.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing PersistentVolumes: %w", err)
+	}
+	pvs := pvList.Items
+	sort.Slice(pvs, func(i, j int) bool { return pvs[i].Name < pvs[j].Name })
+
+	report := &Report{Results: []Result{}}
+	for i := range pvs {
+		pv := &pvs[i]
+		if !a.labeler.CanLabel(pv) {
+			report.Skipped++
+			continue
+		}
+
+		if err := a.limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+		report.Checked++
+
+		result := Result{PV: pv.Name, UID: string(pv.UID)}
+		cloudLabels, err := a.labeler.CloudLabels(ctx, pv)
+		if err != nil {
+			klog.ErrorS(err, "Failed to look up volume labels", "pv", klog.KObj(pv))
+			result.Error = err.Error()
+		} else {
+			result.Differences = admission.CompareTopology(pv, cloudLabels)
+		}
+		if result.Error != "" || len(result.Differences) > 0 {
+			report.Results = append(report.Results, result)
+		}
+	}
+
+	return report, nil
+}
+
+// RecordEvents records a Warning Event on every PV that disagrees with the
+// cloud provider.
+func (a *Auditor) RecordEvents(ctx context.Context, report *Report) error {
+	for _, result := range report.Results {
+		if len(result.Differences) == 0 {
+			continue
+		}
+
+		var diffs []string
+		for _, diff := range result.Differences {
+			diffs = append(diffs, diff.String())
+		}
+
+		now := metav1.Now()
+		event := &corev1.Event{
+			ObjectMeta: metav1.ObjectMeta{
+				// Events of cluster-scoped objects are recorded in the default namespace
+				Name:      fmt.Sprintf("%s.%x", result.PV, now.UnixNano()),
+				Namespace: metav1.NamespaceDefault,
+			},
+			InvolvedObject: corev1.ObjectReference{
+				Kind:       "PersistentVolume",
+				APIVersion: "v1",
+				Name:       result.PV,
+				UID:        types.UID(result.UID),
+			},
+			Reason:         EventReasonTopologyDrift,
+			Message:        "Topology disagrees with the cloud provider: " + strings.Join(diffs, "; "),
+			Type:           corev1.EventTypeWarning,
+			Source:         corev1.EventSource{Component: "cloud-pv-admission-labeler"},
+			FirstTimestamp: now,
+			LastTimestamp:  now,
+			Count:          1,
+		}
+		if _, err := a.client.CoreV1().Events(metav1.NamespaceDefault).Create(ctx, event, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("error recording Event for PersistentVolume %s: %w", result.PV, err)
+		}
+	}
+	return nil
+}
+
+// WriteTable writes the report as a table with one row per difference or error.
+func (r *Report) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PERSISTENTVOLUME\tFIELD\tACTUAL\tEXPECTED")
+	for _, result := range r.Results {
+		if result.Error != "" {
+			fmt.Fprintf(tw, "%s\t<error>\t%s\t\n", result.PV, result.Error)
+			continue
+		}
+		for _, diff := range result.Differences {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", result.PV, diff.Field, diff.Actual, diff.Expected)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "\n%d PersistentVolumes checked, %d skipped, %d with differences or errors\n", r.Checked, r.Skipped, len(r.Results))
+	return err
+}
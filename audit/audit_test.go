@@ -0,0 +1,103 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"sigs.k8s.io/cloud-pv-admission-labeler/admission"
+)
+
+type fakeLabeler struct {
+	labels map[string]map[string]string
+	errs   map[string]error
+}
+
+func (f *fakeLabeler) CanLabel(pv *corev1.PersistentVolume) bool {
+	return admission.IsLabelableVolume(pv)
+}
+
+func (f *fakeLabeler) CloudLabels(ctx context.Context, pv *corev1.PersistentVolume) (map[string]string, error) {
+	return f.labels[pv.Name], f.errs[pv.Name]
+}
+
+func ebsPV(name string, labels map[string]string) *corev1.PersistentVolume {
+	return &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				AWSElasticBlockStore: &corev1.AWSElasticBlockStoreVolumeSource{VolumeID: "vol-" + name},
+			},
+		},
+	}
+}
+
+func Test_Auditor(t *testing.T) {
+	nfsPV := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "nfs"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				NFS: &corev1.NFSVolumeSource{Server: "nfs.example.com", Path: "/export"},
+			},
+		},
+	}
+	zoneA := map[string]string{corev1.LabelTopologyZone: "us-east-1a"}
+	client := fake.NewSimpleClientset(
+		ebsPV("ok", zoneA),
+		ebsPV("drifted", map[string]string{corev1.LabelTopologyZone: "us-east-1b"}),
+		ebsPV("broken", nil),
+		nfsPV,
+	)
+	labeler := &fakeLabeler{
+		labels: map[string]map[string]string{"ok": zoneA, "drifted": zoneA},
+		errs:   map[string]error{"broken": errors.New("volume not found")},
+	}
+	auditor := NewAuditor(client, labeler, Config{QPS: 100, Burst: 10})
+
+	report, err := auditor.Run(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedReport := &Report{
+		Checked: 3,
+		Skipped: 1,
+		Results: []Result{
+			{PV: "broken", Error: "volume not found"},
+			{PV: "drifted", Differences: []admission.TopologyDifference{{Field: "labels[topology.kubernetes.io/zone]", Actual: "us-east-1b", Expected: "us-east-1a"}}},
+		},
+	}
+	if !reflect.DeepEqual(report, expectedReport) {
+		t.Logf("actual report: %+v", report)
+		t.Logf("expected report: %+v", expectedReport)
+		t.Fatal("unexpected report")
+	}
+
+	var table bytes.Buffer
+	if err := report.WriteTable(&table); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(table.String(), "drifted") || !strings.Contains(table.String(), "3 PersistentVolumes checked, 1 skipped") {
+		t.Errorf("unexpected table:\n%s", table.String())
+	}
+
+	if err := auditor.RecordEvents(context.Background(), report); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	events, err := client.CoreV1().Events(metav1.NamespaceDefault).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(events.Items) != 1 {
+		t.Fatalf("expected 1 Event, got %d", len(events.Items))
+	}
+	if event := events.Items[0]; event.InvolvedObject.Name != "drifted" || event.Reason != EventReasonTopologyDrift || event.Type != corev1.EventTypeWarning {
+		t.Errorf("unexpected Event: %+v", event)
+	}
+}
@@ -0,0 +1,126 @@
+// Package auditlog writes a structured JSON record of every labeling decision
+// of the webhook, separately from the klog output.
+package auditlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// Label sources recorded when the labels do not come from a lookup reporting
+// its own source.
+const (
+	// LabelSourceExisting is recorded when the existing labels of a dynamically
+	// provisioned PV are trusted.
+	LabelSourceExisting = "existing"
+	// LabelSourcePreserved is recorded when the labels of an updated PV are
+	// kept from the old PV.
+	LabelSourcePreserved = "preserved"
+	// LabelSourceLookup is recorded when the labels are looked up from the
+	// labeler of the PV's cloud provider.
+	LabelSourceLookup = "lookup"
+)
+
+// Node affinity outcomes
+const (
+	// NodeAffinityAdded is recorded when node affinity for the labels is added
+	// without conflicting with the PV's node affinity.
+	NodeAffinityAdded = "added"
+	// NodeAffinityMerged is recorded when conflicts with the PV's node affinity
+	// were resolved according to the node affinity strategy.
+	NodeAffinityMerged = "merged"
+	// NodeAffinityConflict is recorded when the PV is denied because its node
+	// affinity conflicts with the labels.
+	NodeAffinityConflict = "conflict"
+	// NodeAffinityImmutable is recorded when only the labels of an updated PV
+	// are set since its node affinity cannot be changed.
+	NodeAffinityImmutable = "immutable"
+)
+
+// Record is the audit record of an admission request.
+type Record struct {
+	Time      time.Time `json:"time"`
+	UID       types.UID `json:"uid"`
+	Operation string    `json:"operation"`
+	User      string    `json:"user"`
+	PV        string    `json:"pv"`
+	// Volume is the identity of the PV's volume, e.g. its PD name, EBS volume
+	// ID, Azure disk URI, vSphere volume path or CSI volume handle.
+	Volume      string `json:"volume,omitempty"`
+	VolumeType  string `json:"volumeType"`
+	Provider    string `json:"provider"`
+	LabelSource string `json:"labelSource,omitempty"`
+	// Labels are the topology labels applied to the PV.
+	Labels               map[string]string `json:"labels,omitempty"`
+	Patch                json.RawMessage   `json:"patch,omitempty"`
+	NodeAffinity         string            `json:"nodeAffinity,omitempty"`
+	NodeAffinityStrategy string            `json:"nodeAffinityStrategy,omitempty"`
+	Allowed              bool              `json:"allowed"`
+	Outcome              string            `json:"outcome"`
+	Reason               string            `json:"reason"`
+	Message              string            `json:"message,omitempty"`
+	Warnings             []string          `json:"warnings,omitempty"`
+	LatencySeconds       float64           `json:"latencySeconds"`
+}
+
+// FileConfig configures the rotation of an audit log file.
+type FileConfig struct {
+	// MaxSizeMB is the size in megabytes at which the file is rotated.
+	MaxSizeMB int
+	// MaxBackups is the number of rotated files kept, all if zero.
+	MaxBackups int
+	// MaxAgeDays is how long rotated files are kept, forever if zero.
+	MaxAgeDays int
+	// Compress gzips the rotated files.
+	Compress bool
+}
+
+// Logger writes audit records as JSON lines.
+type Logger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// New returns a Logger writing to w.
+func New(w io.Writer) *Logger {
+	return &Logger{w: w}
+}
+
+// NewFile returns a Logger writing to the file at path, rotated according to
+// the config, or to stdout if path is "-".
+func NewFile(path string, config FileConfig) *Logger {
+	if path == "-" {
+		return New(os.Stdout)
+	}
+	return New(&lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    config.MaxSizeMB,
+		MaxBackups: config.MaxBackups,
+		MaxAge:     config.MaxAgeDays,
+		Compress:   config.Compress,
+	})
+}
+
+// Log writes the record. Failures are logged since the admission response
+// must not depend on them.
+func (l *Logger) Log(record *Record) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		klog.ErrorS(err, "failed to encode audit record", "uid", record.UID)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := fmt.Fprintf(l.w, "%s\n", data); err != nil {
+		klog.ErrorS(err, "failed to write audit record", "uid", record.UID)
+	}
+}
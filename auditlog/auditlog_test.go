@@ -0,0 +1,51 @@
+package auditlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_Logger(t *testing.T) {
+	records := []*Record{
+		{UID: "uid-1", PV: "pv-1", Labels: map[string]string{"topology.kubernetes.io/zone": "zone1"}, Patch: json.RawMessage(`[{"op":"add"}]`)},
+		{UID: "uid-2", PV: "pv-2", Outcome: "rejected"},
+	}
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	var buf bytes.Buffer
+	for name, logger := range map[string]*Logger{"writer": New(&buf), "file": NewFile(path, FileConfig{MaxSizeMB: 1})} {
+		t.Run(name, func(t *testing.T) {
+			for _, record := range records {
+				logger.Log(record)
+			}
+
+			data := buf.Bytes()
+			if name == "file" {
+				var err error
+				if data, err = os.ReadFile(path); err != nil {
+					t.Fatalf("failed to read audit log: %v", err)
+				}
+			}
+
+			var logged []*Record
+			scanner := bufio.NewScanner(bytes.NewReader(data))
+			for scanner.Scan() {
+				record := &Record{}
+				if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+					t.Fatalf("failed to decode audit record %q: %v", scanner.Text(), err)
+				}
+				logged = append(logged, record)
+			}
+			if !reflect.DeepEqual(logged, records) {
+				t.Logf("actual records: %s", data)
+				t.Logf("expected records: %+v", records)
+				t.Error("unexpected audit records")
+			}
+		})
+	}
+}
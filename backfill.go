@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"k8s.io/client-go/informers"
+
+	"sigs.k8s.io/cloud-pv-admission-labeler/admission"
+	"sigs.k8s.io/cloud-pv-admission-labeler/backfill"
+)
+
+// runBackfill implements the backfill command: it adds the missing cloud
+// provider labels to the PersistentVolumes already in the cluster, either
+// once or continuously. It returns the exit code of the command.
+func runBackfill(pvLabelAdmission *admission.PVLabelAdmission, args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	dryRun := fs.Bool("dry-run", false, "log the patches instead of applying them")
+	once := fs.Bool("once", false, "process all PersistentVolumes once, print a summary and exit instead of watching them")
+	qps := fs.Float64("qps", 5, "the maximum number of PersistentVolumes looked up from the cloud provider per second")
+	burst := fs.Int("burst", 10, "the maximum burst of PersistentVolumes looked up from the cloud provider")
+	workers := fs.Int("workers", 2, "the number of PersistentVolumes processed concurrently when watching")
+	reportPeriod := fs.Duration("report-period", 10*time.Minute, "how often the summary is logged when watching, disabled if zero")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s [flags] backfill [--dry-run] [--once]\n\n", os.Args[0])
+		fmt.Fprintf(stderr, "Adds the missing cloud provider labels to the PersistentVolumes in the cluster.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *qps <= 0 || *burst <= 0 {
+		fmt.Fprintf(stderr, "--qps and --burst must be positive\n")
+		return 2
+	}
+
+	client, err := newKubeClient()
+	if err != nil {
+		fmt.Fprintf(stderr, "error creating Kubernetes client: %v\n", err)
+		return 1
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	informerFactory := informers.NewSharedInformerFactory(client, 0)
+	controller := backfill.NewController(client, informerFactory.Core().V1().PersistentVolumes(), pvLabelAdmission, backfill.Config{
+		DryRun:       *dryRun,
+		QPS:          float32(*qps),
+		Burst:        *burst,
+		ReportPeriod: *reportPeriod,
+	})
+	informerFactory.Start(ctx.Done())
+	defer informerFactory.Shutdown()
+
+	if !*once {
+		controller.Run(ctx, *workers)
+		return 0
+	}
+
+	summary, err := controller.RunOnce(ctx)
+	fmt.Fprintln(stdout, summary)
+	if err != nil {
+		fmt.Fprintf(stderr, "error backfilling PersistentVolumes: %v\n", err)
+		return 1
+	}
+	if summary.Failed > 0 {
+		return 1
+	}
+	return 0
+}
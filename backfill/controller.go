@@ -0,0 +1,293 @@
+package backfill
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+)
+
+// maxRetries is how many times a PV is retried before it is left failed until its next update or resync.
+const maxRetries = 5
+
+// Labeler computes the patch adding the missing cloud provider labels to a PV.
+// It is implemented by admission.PVLabelAdmission.
+type Labeler interface {
+	CanLabel(pv *corev1.PersistentVolume) bool
+	IsLabeled(pv *corev1.PersistentVolume) bool
+	LabelPatch(ctx context.Context, pv *corev1.PersistentVolume) ([]byte, error)
+}
+
+// Result is the outcome of backfilling a PV.
+type Result string
+
+const (
+	// ResultLabeled is recorded when the PV was patched, or would have been in dry-run mode.
+	ResultLabeled Result = "labeled"
+	// ResultUpToDate is recorded when the PV already has all its labels.
+	ResultUpToDate Result = "up-to-date"
+	// ResultSkipped is recorded when the PV's volume is not one the webhook labels.
+	ResultSkipped Result = "skipped"
+	// ResultFailed is recorded when the labels could not be retrieved or the PV could not be patched.
+	ResultFailed Result = "failed"
+)
+
+// Summary counts the PVs by the result of their last backfill.
+type Summary struct {
+	Labeled  int `json:"labeled"`
+	UpToDate int `json:"upToDate"`
+	Skipped  int `json:"skipped"`
+	Failed   int `json:"failed"`
+}
+
+func (s Summary) String() string {
+	return fmt.Sprintf("labeled=%d up-to-date=%d skipped=%d failed=%d", s.Labeled, s.UpToDate, s.Skipped, s.Failed)
+}
+
+// Config configures the Controller.
+type Config struct {
+	// DryRun logs the patches instead of applying them.
+	DryRun bool
+	// QPS and Burst limit how many PVs are looked up from the cloud provider.
+	QPS   float32
+	Burst int
+	// ReportPeriod is how often the summary is logged while the controller runs. Zero disables the report.
+	ReportPeriod time.Duration
+}
+
+// Controller adds the cloud provider labels to existing PVs that are missing
+// them, e.g. because they were created before the webhook was installed or
+// admitted while the cloud provider was unavailable. Its patches only set
+// labels, but they are admitted by the webhook as updates, which adds node
+// affinity to PVs that have none.
+type Controller struct {
+	client   kubernetes.Interface
+	pvLister corelisters.PersistentVolumeLister
+	pvSynced cache.InformerSynced
+	labeler  Labeler
+	config   Config
+	limiter  flowcontrol.RateLimiter
+	queue    workqueue.RateLimitingInterface
+
+	mu      sync.Mutex
+	results map[string]Result
+}
+
+// NewController returns a Controller backfilling the PVs of the given informer.
+func NewController(client kubernetes.Interface, pvInformer coreinformers.PersistentVolumeInformer, labeler Labeler, config Config) *Controller {
+	c := &Controller{
+		client:   client,
+		pvLister: pvInformer.Lister(),
+		pvSynced: pvInformer.Informer().HasSynced,
+		labeler:  labeler,
+		config:   config,
+		limiter:  flowcontrol.NewTokenBucketRateLimiter(config.QPS, config.Burst),
+		queue:    workqueue.NewRateLimitingQueueWithConfig(workqueue.DefaultControllerRateLimiter(), workqueue.RateLimitingQueueConfig{Name: "backfill"}),
+		results:  make(map[string]Result),
+	}
+
+	pvInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueue,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			// Only look PVs up again when their labels may have been removed,
+			// not on every status update.
+			oldPV, newPV := oldObj.(*corev1.PersistentVolume), newObj.(*corev1.PersistentVolume)
+			if !apiequality.Semantic.DeepEqual(oldPV.Labels, newPV.Labels) || !apiequality.Semantic.DeepEqual(oldPV.Annotations, newPV.Annotations) {
+				c.enqueue(newObj)
+			}
+		},
+		DeleteFunc: c.forget,
+	})
+
+	return c
+}
+
+// Run backfills PVs as they are added or updated until the context is done.
+func (c *Controller) Run(ctx context.Context, workers int) {
+	defer utilruntime.HandleCrash()
+	defer c.queue.ShutDown()
+
+	klog.InfoS("Starting backfill controller", "dryRun", c.config.DryRun)
+	defer func() {
+		klog.InfoS("Stopping backfill controller", "summary", c.Summary())
+	}()
+
+	if !cache.WaitForNamedCacheSync("backfill", ctx.Done(), c.pvSynced) {
+		return
+	}
+
+	for i := 0; i < workers; i++ {
+		go wait.UntilWithContext(ctx, c.worker, time.Second)
+	}
+	if c.config.ReportPeriod > 0 {
+		go wait.UntilWithContext(ctx, func(ctx context.Context) {
+			klog.InfoS("Backfill summary", "summary", c.Summary())
+		}, c.config.ReportPeriod)
+	}
+
+	<-ctx.Done()
+}
+
+// RunOnce backfills all PVs once and returns the summary.
+func (c *Controller) RunOnce(ctx context.Context) (Summary, error) {
+	if !cache.WaitForNamedCacheSync("backfill", ctx.Done(), c.pvSynced) {
+		return Summary{}, fmt.Errorf("error waiting for PersistentVolume cache to sync: %w", ctx.Err())
+	}
+
+	pvs, err := c.pvLister.List(labels.Everything())
+	if err != nil {
+		return Summary{}, err
+	}
+	sort.Slice(pvs, func(i, j int) bool { return pvs[i].Name < pvs[j].Name })
+
+	for _, pv := range pvs {
+		if err := ctx.Err(); err != nil {
+			return c.Summary(), err
+		}
+		result, err := c.syncPV(ctx, pv)
+		if err != nil {
+			klog.ErrorS(err, "Failed to backfill labels", "pv", klog.KObj(pv))
+		}
+		c.record(pv.Name, result)
+	}
+
+	return c.Summary(), nil
+}
+
+// Summary returns the result counts of the PVs processed so far.
+func (c *Controller) Summary() Summary {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var summary Summary
+	for _, result := range c.results {
+		switch result {
+		case ResultLabeled:
+			summary.Labeled++
+		case ResultUpToDate:
+			summary.UpToDate++
+		case ResultSkipped:
+			summary.Skipped++
+		case ResultFailed:
+			summary.Failed++
+		}
+	}
+	return summary
+}
+
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+func (c *Controller) forget(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.results, key)
+}
+
+func (c *Controller) worker(ctx context.Context) {
+	for c.processNextItem(ctx) {
+	}
+}
+
+func (c *Controller) processNextItem(ctx context.Context) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	pv, err := c.pvLister.Get(key.(string))
+	if apierrors.IsNotFound(err) {
+		c.queue.Forget(key)
+		return true
+	}
+	if err != nil {
+		utilruntime.HandleError(err)
+		return true
+	}
+
+	result, err := c.syncPV(ctx, pv)
+	c.record(pv.Name, result)
+	if err == nil {
+		c.queue.Forget(key)
+		return true
+	}
+
+	if c.queue.NumRequeues(key) < maxRetries {
+		klog.V(2).InfoS("Failed to backfill labels, retrying", "pv", klog.KObj(pv), "err", err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	klog.ErrorS(err, "Failed to backfill labels, giving up", "pv", klog.KObj(pv))
+	c.queue.Forget(key)
+	return true
+}
+
+// syncPV patches the PV with the labels it is missing. PVs that already have
+// their labels are not looked up, including after they were patched.
+func (c *Controller) syncPV(ctx context.Context, pv *corev1.PersistentVolume) (Result, error) {
+	if !c.labeler.CanLabel(pv) {
+		return ResultSkipped, nil
+	}
+	if c.labeler.IsLabeled(pv) {
+		return ResultUpToDate, nil
+	}
+
+	if err := c.limiter.Wait(ctx); err != nil {
+		return ResultFailed, err
+	}
+
+	patch, err := c.labeler.LabelPatch(ctx, pv)
+	if err != nil {
+		return ResultFailed, err
+	}
+	if patch == nil {
+		return ResultUpToDate, nil
+	}
+
+	if c.config.DryRun {
+		klog.InfoS("Would patch PersistentVolume (dry run)", "pv", klog.KObj(pv), "patch", string(patch))
+		return ResultLabeled, nil
+	}
+
+	if _, err := c.client.CoreV1().PersistentVolumes().Patch(ctx, pv.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return ResultFailed, fmt.Errorf("error patching PersistentVolume %s: %w", pv.Name, err)
+	}
+	klog.InfoS("Patched PersistentVolume", "pv", klog.KObj(pv), "patch", string(patch))
+	return ResultLabeled, nil
+}
+
+func (c *Controller) record(key string, result Result) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.results[key] = result
+}
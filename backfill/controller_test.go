@@ -0,0 +1,137 @@
+package backfill
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"sigs.k8s.io/cloud-pv-admission-labeler/admission"
+)
+
+type fakeLabeler struct {
+	patches map[string][]byte
+	errs    map[string]error
+	labeled map[string]bool
+
+	mu      sync.Mutex
+	lookups []string
+}
+
+func (f *fakeLabeler) CanLabel(pv *corev1.PersistentVolume) bool {
+	return admission.IsLabelableVolume(pv)
+}
+
+func (f *fakeLabeler) IsLabeled(pv *corev1.PersistentVolume) bool {
+	return f.labeled[pv.Name]
+}
+
+func (f *fakeLabeler) LabelPatch(ctx context.Context, pv *corev1.PersistentVolume) ([]byte, error) {
+	f.mu.Lock()
+	f.lookups = append(f.lookups, pv.Name)
+	f.mu.Unlock()
+	return f.patches[pv.Name], f.errs[pv.Name]
+}
+
+func ebsPV(name string) *corev1.PersistentVolume {
+	return &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				AWSElasticBlockStore: &corev1.AWSElasticBlockStoreVolumeSource{VolumeID: "vol-" + name},
+			},
+		},
+	}
+}
+
+func Test_RunOnce(t *testing.T) {
+	nfsPV := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "nfs"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				NFS: &corev1.NFSVolumeSource{Server: "nfs.example.com", Path: "/export"},
+			},
+		},
+	}
+	patch := []byte(`{"metadata":{"labels":{"topology.kubernetes.io/zone":"us-east-1a"}}}`)
+
+	testcases := []struct {
+		name            string
+		dryRun          bool
+		expectedSummary Summary
+		expectedPatches int
+	}{
+		{
+			name:            "patches PVs missing labels",
+			expectedSummary: Summary{Labeled: 1, UpToDate: 2, Skipped: 1, Failed: 1},
+			expectedPatches: 1,
+		},
+		{
+			name:            "dry run does not patch",
+			dryRun:          true,
+			expectedSummary: Summary{Labeled: 1, UpToDate: 2, Skipped: 1, Failed: 1},
+			expectedPatches: 0,
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			labeler := &fakeLabeler{
+				patches: map[string][]byte{"missing": patch},
+				errs:    map[string]error{"broken": errors.New("volume not found")},
+				labeled: map[string]bool{"complete": true},
+			}
+			client := fake.NewSimpleClientset(ebsPV("missing"), ebsPV("labeled"), ebsPV("broken"), ebsPV("complete"), nfsPV)
+			var patches int
+			client.PrependReactor("patch", "persistentvolumes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				patches++
+				if patchType := action.(k8stesting.PatchAction).GetPatchType(); patchType != types.MergePatchType {
+					t.Errorf("expected merge patch, got %s", patchType)
+				}
+				if string(action.(k8stesting.PatchAction).GetPatch()) != string(patch) {
+					t.Errorf("unexpected patch: %s", action.(k8stesting.PatchAction).GetPatch())
+				}
+				return true, nil, nil
+			})
+
+			informerFactory := informers.NewSharedInformerFactory(client, 0)
+			controller := NewController(client, informerFactory.Core().V1().PersistentVolumes(), labeler, Config{
+				DryRun: testcase.dryRun,
+				QPS:    100,
+				Burst:  10,
+			})
+			informerFactory.Start(ctx.Done())
+
+			summary, err := controller.RunOnce(ctx)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if summary != testcase.expectedSummary {
+				t.Logf("actual summary: %v", summary)
+				t.Logf("expected summary: %v", testcase.expectedSummary)
+				t.Error("unexpected summary")
+			}
+			if patches != testcase.expectedPatches {
+				t.Errorf("expected %d patches, got %d", testcase.expectedPatches, patches)
+			}
+			// PVs that are already labeled are not looked up
+			sort.Strings(labeler.lookups)
+			if expected := []string{"broken", "labeled", "missing"}; !reflect.DeepEqual(labeler.lookups, expected) {
+				t.Errorf("expected lookups of %v, got %v", expected, labeler.lookups)
+			}
+		})
+	}
+}
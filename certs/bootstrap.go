@@ -0,0 +1,467 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	certutil "k8s.io/client-go/util/cert"
+	"k8s.io/client-go/util/keyutil"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// Keys of the generated certificates in the bootstrap Secret
+	SecretCACertKey     = "ca.crt"
+	SecretCAKeyKey      = "ca.key"
+	SecretCABundleKey   = "ca-bundle.crt"
+	SecretServerCertKey = "server.crt"
+	SecretServerKeyKey  = "server.key"
+
+	// caValidityFactor is how much longer the CA is valid than the serving certificates it signs.
+	caValidityFactor = 10
+)
+
+// BootstrapConfig configures where the Bootstrapper stores the generated
+// certificates and which webhook configuration it injects the CA into.
+type BootstrapConfig struct {
+	// Namespace and SecretName of the Secret holding the CA and serving certificate.
+	Namespace  string
+	SecretName string
+	// ServiceName is the name of the webhook Service; it is used for the serving certificate's DNS names.
+	ServiceName string
+	// WebhookName is the name of the MutatingWebhookConfiguration whose caBundle is injected.
+	WebhookName string
+	// ValidatingWebhookName is the name of the ValidatingWebhookConfiguration whose caBundle is
+	// injected. It is optional: nothing is injected if it is empty or the configuration does not exist.
+	ValidatingWebhookName string
+	// Validity is how long generated serving certificates are valid. The CA is valid for ten times as long.
+	Validity time.Duration
+	// CheckInterval is how often the certificates are checked for rotation.
+	CheckInterval time.Duration
+}
+
+// Bootstrapper generates a CA and a serving certificate signed by it, stores
+// both in a Secret, injects the CA bundle into the webhook configuration and
+// rotates the certificates before they expire.
+type Bootstrapper struct {
+	client kubernetes.Interface
+	config BootstrapConfig
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	notAfter time.Time
+}
+
+// NewBootstrapper returns a Bootstrapper using the given client and configuration.
+func NewBootstrapper(client kubernetes.Interface, config BootstrapConfig) *Bootstrapper {
+	return &Bootstrapper{
+		client: client,
+		config: config,
+	}
+}
+
+// Start checks the certificates periodically until the context is done,
+// rotating them and re-injecting the CA bundle as needed.
+func (b *Bootstrapper) Start(ctx context.Context) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := b.EnsureCertificates(ctx); err != nil {
+			klog.ErrorS(err, "failed to ensure webhook certificates, keeping the current one", "secret", klog.KRef(b.config.Namespace, b.config.SecretName))
+		}
+	}, b.config.CheckInterval)
+}
+
+// GetCertificate returns the current serving certificate. It is meant to be
+// used as tls.Config.GetCertificate.
+func (b *Bootstrapper) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.cert == nil {
+		return nil, errors.New("serving certificate has not been generated yet")
+	}
+	return b.cert, nil
+}
+
+// NotAfter returns the expiry date of the current serving certificate.
+func (b *Bootstrapper) NotAfter() time.Time {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.notAfter
+}
+
+// EnsureCertificates makes sure the Secret holds a valid CA and serving
+// certificate, generating new ones if they are missing or about to expire,
+// injects the CA bundle into the webhook and loads the serving certificate.
+// The serving certificate is only switched once the API server trusts its CA,
+// so that a failed injection after a CA rotation keeps the current one.
+func (b *Bootstrapper) EnsureCertificates(ctx context.Context) error {
+	var secret *corev1.Secret
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var err error
+		secret, err = b.ensureSecret(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.X509KeyPair(secret.Data[SecretServerCertKey], secret.Data[SecretServerKeyKey])
+	if err != nil {
+		return fmt.Errorf("error loading serving certificate from secret %s/%s: %v", secret.Namespace, secret.Name, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("error parsing serving certificate: %v", err)
+	}
+	cert.Leaf = leaf
+
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		return b.injectCABundle(ctx, secret.Data[SecretCABundleKey])
+	})
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	changed := b.cert == nil || !bytes.Equal(b.cert.Certificate[0], cert.Certificate[0])
+	b.cert = &cert
+	b.notAfter = leaf.NotAfter
+	b.mu.Unlock()
+	if changed {
+		klog.InfoS("Loaded serving certificate", "secret", klog.KObj(secret), "notAfter", leaf.NotAfter)
+	}
+	return nil
+}
+
+// ensureSecret returns the bootstrap Secret, creating or updating it if the
+// certificates it holds are missing, invalid or due for rotation.
+func (b *Bootstrapper) ensureSecret(ctx context.Context) (*corev1.Secret, error) {
+	secret, err := b.client.CoreV1().Secrets(b.config.Namespace).Get(ctx, b.config.SecretName, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("error getting secret %s/%s: %v", b.config.Namespace, b.config.SecretName, err)
+	}
+	exists := err == nil
+	if !exists {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: b.config.Namespace,
+				Name:      b.config.SecretName,
+			},
+		}
+	}
+
+	data := make(map[string][]byte, len(secret.Data))
+	for k, v := range secret.Data {
+		data[k] = v
+	}
+
+	now := time.Now()
+	caValidity := b.config.Validity * caValidityFactor
+	ca, caKey, err := parseCertAndKey(data[SecretCACertKey], data[SecretCAKeyKey])
+	if err != nil || needsRotation(ca, caValidity, now) {
+		klog.InfoS("Generating webhook CA certificate", "secret", klog.KObj(secret), "reason", rotationReason(err))
+		caPEM, caKeyPEM, err := generateCA(b.config.ServiceName, caValidity)
+		if err != nil {
+			return nil, err
+		}
+		data[SecretCACertKey] = caPEM
+		data[SecretCAKeyKey] = caKeyPEM
+		ca, caKey, err = parseCertAndKey(caPEM, caKeyPEM)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cert, _, err := parseCertAndKey(data[SecretServerCertKey], data[SecretServerKeyKey])
+	if err == nil && cert.CheckSignatureFrom(ca) != nil {
+		err = errors.New("serving certificate is not signed by the current CA")
+	}
+	if err != nil || needsRotation(cert, b.config.Validity, now) {
+		klog.InfoS("Generating webhook serving certificate", "secret", klog.KObj(secret), "reason", rotationReason(err))
+		certPEM, keyPEM, err := generateServingCert(ca, caKey, b.dnsNames(), b.config.Validity)
+		if err != nil {
+			return nil, err
+		}
+		data[SecretServerCertKey] = certPEM
+		data[SecretServerKeyKey] = keyPEM
+	}
+
+	caBundle, err := buildCABundle(data[SecretCACertKey], data[SecretCABundleKey], now)
+	if err != nil {
+		return nil, err
+	}
+	data[SecretCABundleKey] = caBundle
+
+	if exists && secretDataEqual(secret.Data, data) {
+		return secret, nil
+	}
+
+	secret = secret.DeepCopy()
+	secret.Data = data
+	if !exists {
+		secret, err = b.client.CoreV1().Secrets(b.config.Namespace).Create(ctx, secret, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			// Another replica created the secret first, retry with its certificates
+			return nil, apierrors.NewConflict(corev1.Resource("secrets"), b.config.SecretName, err)
+		}
+	} else {
+		secret, err = b.client.CoreV1().Secrets(b.config.Namespace).Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+// injectCABundle sets the caBundle of every webhook in the MutatingWebhookConfiguration
+// and the ValidatingWebhookConfiguration.
+func (b *Bootstrapper) injectCABundle(ctx context.Context, caBundle []byte) error {
+	if err := b.injectMutatingCABundle(ctx, caBundle); err != nil {
+		return err
+	}
+	return b.injectValidatingCABundle(ctx, caBundle)
+}
+
+func (b *Bootstrapper) injectMutatingCABundle(ctx context.Context, caBundle []byte) error {
+	webhookConfig, err := b.client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, b.config.WebhookName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("error getting MutatingWebhookConfiguration %s: %v", b.config.WebhookName, err)
+	}
+
+	changed := false
+	webhookConfig = webhookConfig.DeepCopy()
+	for i := range webhookConfig.Webhooks {
+		if !bytes.Equal(webhookConfig.Webhooks[i].ClientConfig.CABundle, caBundle) {
+			webhookConfig.Webhooks[i].ClientConfig.CABundle = caBundle
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	_, err = b.client.AdmissionregistrationV1().MutatingWebhookConfigurations().Update(ctx, webhookConfig, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+
+	klog.InfoS("Injected CA bundle into MutatingWebhookConfiguration", "name", b.config.WebhookName)
+	return nil
+}
+
+func (b *Bootstrapper) injectValidatingCABundle(ctx context.Context, caBundle []byte) error {
+	if b.config.ValidatingWebhookName == "" {
+		return nil
+	}
+	webhookConfig, err := b.client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(ctx, b.config.ValidatingWebhookName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		// Topology validation is not enabled
+		klog.V(2).InfoS("ValidatingWebhookConfiguration not found, not injecting CA bundle", "name", b.config.ValidatingWebhookName)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error getting ValidatingWebhookConfiguration %s: %v", b.config.ValidatingWebhookName, err)
+	}
+
+	changed := false
+	webhookConfig = webhookConfig.DeepCopy()
+	for i := range webhookConfig.Webhooks {
+		if !bytes.Equal(webhookConfig.Webhooks[i].ClientConfig.CABundle, caBundle) {
+			webhookConfig.Webhooks[i].ClientConfig.CABundle = caBundle
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	_, err = b.client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Update(ctx, webhookConfig, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+
+	klog.InfoS("Injected CA bundle into ValidatingWebhookConfiguration", "name", b.config.ValidatingWebhookName)
+	return nil
+}
+
+func (b *Bootstrapper) dnsNames() []string {
+	return []string{
+		b.config.ServiceName,
+		fmt.Sprintf("%s.%s", b.config.ServiceName, b.config.Namespace),
+		fmt.Sprintf("%s.%s.svc", b.config.ServiceName, b.config.Namespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", b.config.ServiceName, b.config.Namespace),
+	}
+}
+
+// needsRotation returns true once less than a third of the certificate's
+// validity is left.
+func needsRotation(cert *x509.Certificate, validity time.Duration, now time.Time) bool {
+	return cert.NotAfter.Sub(now) < validity/3
+}
+
+func rotationReason(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "certificate is about to expire"
+}
+
+// buildCABundle returns the current CA followed by any previous CAs from the
+// existing bundle that have not expired yet, so that certificates signed by
+// the previous CA keep being trusted while the new one is rolled out.
+func buildCABundle(caPEM, existingBundle []byte, now time.Time) ([]byte, error) {
+	cas, err := certutil.ParseCertsPEM(caPEM)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing CA certificate: %v", err)
+	}
+
+	if len(existingBundle) > 0 {
+		previous, err := certutil.ParseCertsPEM(existingBundle)
+		if err != nil {
+			klog.ErrorS(err, "failed to parse existing CA bundle, replacing it")
+		}
+		for _, c := range previous {
+			if !c.Equal(cas[0]) && now.Before(c.NotAfter) {
+				cas = append(cas, c)
+			}
+		}
+	}
+
+	return certutil.EncodeCertificates(cas...)
+}
+
+func parseCertAndKey(certPEM, keyPEM []byte) (*x509.Certificate, crypto.Signer, error) {
+	if len(certPEM) == 0 || len(keyPEM) == 0 {
+		return nil, nil, errors.New("certificate or key not found")
+	}
+
+	certs, err := certutil.ParseCertsPEM(certPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := keyutil.ParsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New("private key is not a crypto.Signer")
+	}
+
+	return certs[0], signer, nil
+}
+
+func generateCA(commonName string, validity time.Duration) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error generating CA key: %v", err)
+	}
+
+	template, err := certificateTemplate(fmt.Sprintf("%s-ca@%d", commonName, time.Now().Unix()), validity)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign
+	template.BasicConstraintsValid = true
+	template.IsCA = true
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating CA certificate: %v", err)
+	}
+
+	return encodeCertAndKey(der, key)
+}
+
+func generateServingCert(ca *x509.Certificate, caKey crypto.Signer, dnsNames []string, validity time.Duration) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error generating serving key: %v", err)
+	}
+
+	template, err := certificateTemplate(dnsNames[0], validity)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.DNSNames = dnsNames
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	if template.NotAfter.After(ca.NotAfter) {
+		template.NotAfter = ca.NotAfter
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating serving certificate: %v", err)
+	}
+
+	return encodeCertAndKey(der, key)
+}
+
+func certificateTemplate(commonName string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).SetInt64(math.MaxInt64-1))
+	if err != nil {
+		return nil, fmt.Errorf("error generating certificate serial number: %v", err)
+	}
+
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: new(big.Int).Add(serial, big.NewInt(1)),
+		Subject:      pkix.Name{CommonName: commonName},
+		// Allow for clock skew between the webhook and the API server
+		NotBefore: now.Add(-time.Hour).UTC(),
+		NotAfter:  now.Add(validity).UTC(),
+	}, nil
+}
+
+func encodeCertAndKey(der []byte, key *ecdsa.PrivateKey) ([]byte, []byte, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM, err := certutil.EncodeCertificates(cert)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyPEM, err := keyutil.MarshalPrivateKeyToPEM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return certPEM, keyPEM, nil
+}
+
+func secretDataEqual(a, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if !bytes.Equal(v, b[k]) {
+			return false
+		}
+	}
+	return true
+}
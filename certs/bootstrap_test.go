@@ -0,0 +1,175 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"strings"
+	"testing"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	certutil "k8s.io/client-go/util/cert"
+)
+
+func Test_EnsureCertificates(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset(&admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "cloud-pvl-admission.k8s.io"},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{
+			{Name: "cloud-pvl-admission.k8s.io"},
+		},
+	}, &admissionregistrationv1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "cloud-pvl-validation.k8s.io"},
+		Webhooks: []admissionregistrationv1.ValidatingWebhook{
+			{Name: "cloud-pvl-validation.k8s.io"},
+		},
+	})
+
+	b := NewBootstrapper(client, BootstrapConfig{
+		Namespace:             "kube-system",
+		SecretName:            "cloud-pv-admission-labeler-certs",
+		ServiceName:           "cloud-pv-admission-labeler",
+		WebhookName:           "cloud-pvl-admission.k8s.io",
+		ValidatingWebhookName: "cloud-pvl-validation.k8s.io",
+		Validity:              24 * time.Hour,
+		CheckInterval:         time.Hour,
+	})
+
+	if _, err := b.GetCertificate(nil); err == nil {
+		t.Error("expected error before certificates are generated")
+	}
+
+	if err := b.EnsureCertificates(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	secret, err := client.CoreV1().Secrets("kube-system").Get(ctx, "cloud-pv-admission-labeler-certs", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error getting secret: %v", err)
+	}
+	for _, key := range []string{SecretCACertKey, SecretCAKeyKey, SecretCABundleKey, SecretServerCertKey, SecretServerKeyKey} {
+		if len(secret.Data[key]) == 0 {
+			t.Errorf("secret is missing %s", key)
+		}
+	}
+
+	webhookConfig, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, "cloud-pvl-admission.k8s.io", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error getting webhook configuration: %v", err)
+	}
+	if !bytes.Equal(webhookConfig.Webhooks[0].ClientConfig.CABundle, secret.Data[SecretCABundleKey]) {
+		t.Error("caBundle was not injected into the webhook configuration")
+	}
+	validatingConfig, err := client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(ctx, "cloud-pvl-validation.k8s.io", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error getting validating webhook configuration: %v", err)
+	}
+	if !bytes.Equal(validatingConfig.Webhooks[0].ClientConfig.CABundle, secret.Data[SecretCABundleKey]) {
+		t.Error("caBundle was not injected into the validating webhook configuration")
+	}
+
+	pool, err := certutil.NewPoolFromBytes(webhookConfig.Webhooks[0].ClientConfig.CABundle)
+	if err != nil {
+		t.Fatalf("unexpected error parsing caBundle: %v", err)
+	}
+	cert, err := b.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := cert.Leaf.Verify(x509.VerifyOptions{
+		DNSName: "cloud-pv-admission-labeler.kube-system.svc",
+		Roots:   pool,
+	}); err != nil {
+		t.Errorf("serving certificate does not verify against caBundle: %v", err)
+	}
+
+	// Certificates that are still valid are not regenerated.
+	if err := b.EnsureCertificates(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	again, _ := b.GetCertificate(nil)
+	if !bytes.Equal(again.Certificate[0], cert.Certificate[0]) {
+		t.Error("serving certificate was regenerated while still valid")
+	}
+}
+
+func Test_EnsureCertificatesWithoutValidatingWebhook(t *testing.T) {
+	// Topology validation is optional, so a missing ValidatingWebhookConfiguration is not an error
+	client := fake.NewSimpleClientset(&admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "cloud-pvl-admission.k8s.io"},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{
+			{Name: "cloud-pvl-admission.k8s.io"},
+		},
+	})
+	b := NewBootstrapper(client, BootstrapConfig{
+		Namespace:             "kube-system",
+		SecretName:            "cloud-pv-admission-labeler-certs",
+		ServiceName:           "cloud-pv-admission-labeler",
+		WebhookName:           "cloud-pvl-admission.k8s.io",
+		ValidatingWebhookName: "cloud-pvl-validation.k8s.io",
+		Validity:              24 * time.Hour,
+		CheckInterval:         time.Hour,
+	})
+
+	if err := b.EnsureCertificates(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := b.GetCertificate(nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func Test_EnsureCertificatesInjectionFailure(t *testing.T) {
+	// The webhook configuration does not exist, so the CA cannot be injected
+	client := fake.NewSimpleClientset()
+	b := NewBootstrapper(client, BootstrapConfig{
+		Namespace:     "kube-system",
+		SecretName:    "cloud-pv-admission-labeler-certs",
+		ServiceName:   "cloud-pv-admission-labeler",
+		WebhookName:   "cloud-pvl-admission.k8s.io",
+		Validity:      24 * time.Hour,
+		CheckInterval: time.Hour,
+	})
+
+	if err := b.EnsureCertificates(context.Background()); err == nil {
+		t.Fatal("expected error injecting CA bundle")
+	}
+	if _, err := b.GetCertificate(nil); err == nil {
+		t.Error("expected serving certificate not to be loaded before its CA is injected")
+	}
+}
+
+func Test_buildCABundle(t *testing.T) {
+	now := time.Now()
+	oldCA, _, err := generateCA("old", time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expiredCA, _, err := generateCA("expired", time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	newCA, _, err := generateCA("new", time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	bundle, err := buildCABundle(newCA, append(append([]byte{}, oldCA...), expiredCA...), now.Add(30*time.Minute))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cas, err := certutil.ParseCertsPEM(bundle)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cas) != 2 {
+		t.Fatalf("expected 2 CAs in bundle, got %d", len(cas))
+	}
+	if !strings.HasPrefix(cas[0].Subject.CommonName, "new") || !strings.HasPrefix(cas[1].Subject.CommonName, "old") {
+		t.Errorf("unexpected CAs in bundle: %s, %s", cas[0].Subject.CommonName, cas[1].Subject.CommonName)
+	}
+}
@@ -0,0 +1,113 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// Watcher serves a TLS certificate and key pair from disk and reloads it
+// whenever the files change, so rotated certificates are picked up without
+// restarting the webhook.
+type Watcher struct {
+	certPath string
+	keyPath  string
+	interval time.Duration
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	certPEM  []byte
+	keyPEM   []byte
+	notAfter time.Time
+}
+
+// NewWatcher returns a Watcher for the given certificate and key paths. The
+// pair is loaded immediately and an error is returned if it is not valid.
+func NewWatcher(certPath, keyPath string, interval time.Duration) (*Watcher, error) {
+	w := &Watcher{
+		certPath: certPath,
+		keyPath:  keyPath,
+		interval: interval,
+	}
+
+	if err := w.reload(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Start polls the certificate and key files until the context is done. If a
+// reload fails the last good certificate keeps being served.
+func (w *Watcher) Start(ctx context.Context) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := w.reload(); err != nil {
+			klog.ErrorS(err, "failed to reload serving certificate, keeping the current one", "certPath", w.certPath, "keyPath", w.keyPath)
+		}
+	}, w.interval)
+}
+
+// GetCertificate returns the current serving certificate. It is meant to be
+// used as tls.Config.GetCertificate.
+func (w *Watcher) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return w.cert, nil
+}
+
+// NotAfter returns the expiry date of the current serving certificate.
+func (w *Watcher) NotAfter() time.Time {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return w.notAfter
+}
+
+func (w *Watcher) reload() error {
+	certPEM, err := os.ReadFile(w.certPath)
+	if err != nil {
+		return fmt.Errorf("error reading certificate file %s: %v", w.certPath, err)
+	}
+
+	keyPEM, err := os.ReadFile(w.keyPath)
+	if err != nil {
+		return fmt.Errorf("error reading key file %s: %v", w.keyPath, err)
+	}
+
+	w.mu.RLock()
+	unchanged := bytes.Equal(certPEM, w.certPEM) && bytes.Equal(keyPEM, w.keyPEM)
+	w.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("error loading certificate and key pair: %v", err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("error parsing certificate: %v", err)
+	}
+	cert.Leaf = leaf
+
+	w.mu.Lock()
+	w.cert = &cert
+	w.certPEM = certPEM
+	w.keyPEM = keyPEM
+	w.notAfter = leaf.NotAfter
+	w.mu.Unlock()
+
+	klog.InfoS("Loaded serving certificate", "certPath", w.certPath, "subject", leaf.Subject.String(), "notAfter", leaf.NotAfter)
+	return nil
+}
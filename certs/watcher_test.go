@@ -0,0 +1,76 @@
+package certs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	certutil "k8s.io/client-go/util/cert"
+)
+
+func writeCertKey(t *testing.T, dir, host string) (string, string) {
+	certPEM, keyPEM, err := certutil.GenerateSelfSignedCertKey(host, nil, nil)
+	if err != nil {
+		t.Fatalf("error generating certificate: %v", err)
+	}
+
+	certPath := filepath.Join(dir, "server.crt")
+	keyPath := filepath.Join(dir, "server.key")
+	if err := os.WriteFile(certPath, certPEM, 0600); err != nil {
+		t.Fatalf("error writing certificate: %v", err)
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatalf("error writing key: %v", err)
+	}
+
+	return certPath, keyPath
+}
+
+func Test_Watcher(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeCertKey(t, dir, "first.example.com")
+
+	w, err := NewWatcher(certPath, keyPath, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cert, _ := w.GetCertificate(nil)
+	if !strings.HasPrefix(cert.Leaf.Subject.CommonName, "first.example.com") {
+		t.Errorf("unexpected certificate common name: %s", cert.Leaf.Subject.CommonName)
+	}
+	if !w.NotAfter().Equal(cert.Leaf.NotAfter) {
+		t.Errorf("unexpected expiry date: %v", w.NotAfter())
+	}
+
+	// Rotated certificate is picked up on reload.
+	writeCertKey(t, dir, "second.example.com")
+	if err := w.reload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cert, _ = w.GetCertificate(nil)
+	if !strings.HasPrefix(cert.Leaf.Subject.CommonName, "second.example.com") {
+		t.Errorf("unexpected certificate common name: %s", cert.Leaf.Subject.CommonName)
+	}
+
+	// Invalid key keeps the last good certificate.
+	if err := os.WriteFile(keyPath, []byte("invalid"), 0600); err != nil {
+		t.Fatalf("error writing key: %v", err)
+	}
+	if err := w.reload(); err == nil {
+		t.Error("expected error reloading invalid key")
+	}
+	cert, _ = w.GetCertificate(nil)
+	if !strings.HasPrefix(cert.Leaf.Subject.CommonName, "second.example.com") {
+		t.Errorf("unexpected certificate common name: %s", cert.Leaf.Subject.CommonName)
+	}
+}
+
+func Test_NewWatcherInvalid(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := NewWatcher(filepath.Join(dir, "missing.crt"), filepath.Join(dir, "missing.key"), time.Second); err == nil {
+		t.Error("expected error for missing certificate files")
+	}
+}
@@ -0,0 +1,130 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/klog/v2"
+)
+
+// Ping is a liveness handler that succeeds as long as the server is serving requests.
+func Ping(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, "ok")
+}
+
+type check struct {
+	name string
+	fn   func() error
+}
+
+// Checker is a readiness handler that succeeds only if all its checks pass.
+type Checker struct {
+	mu     sync.RWMutex
+	checks []check
+}
+
+// NewChecker returns a Checker without any checks.
+func NewChecker() *Checker {
+	return &Checker{}
+}
+
+// AddCheck adds a named check to the Checker.
+func (c *Checker) AddCheck(name string, fn func() error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.checks = append(c.checks, check{name: name, fn: fn})
+}
+
+// ServeHTTP runs all checks and responds with 503 if any of them fails.
+// The result of each check is listed when the verbose query parameter is set.
+func (c *Checker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.RLock()
+	checks := c.checks
+	c.mu.RUnlock()
+
+	var failed bool
+	var output string
+	for _, check := range checks {
+		if err := check.fn(); err != nil {
+			klog.V(2).InfoS("Readiness check failed", "check", check.name, "err", err)
+			failed = true
+			output += fmt.Sprintf("[-]%s failed: %v\n", check.name, err)
+			continue
+		}
+		output += fmt.Sprintf("[+]%s ok\n", check.name)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if failed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "%sreadyz check failed", output)
+		return
+	}
+
+	if _, verbose := r.URL.Query()["verbose"]; verbose {
+		fmt.Fprint(w, output)
+	}
+	fmt.Fprint(w, "ok")
+}
+
+// CloudChecker periodically looks up the labels of a known volume to verify
+// that the cloud provider is reachable and its credentials are valid.
+type CloudChecker struct {
+	pvLabeler cloudprovider.PVLabeler
+	pv        *corev1.PersistentVolume
+	period    time.Duration
+	timeout   time.Duration
+
+	mu      sync.RWMutex
+	lastErr error
+}
+
+// NewCloudChecker returns a CloudChecker looking up the given PV every period.
+// Until the first lookup has completed, Check reports an error.
+func NewCloudChecker(pvLabeler cloudprovider.PVLabeler, pv *corev1.PersistentVolume, period, timeout time.Duration) *CloudChecker {
+	return &CloudChecker{
+		pvLabeler: pvLabeler,
+		pv:        pv,
+		period:    period,
+		timeout:   timeout,
+		lastErr:   errors.New("cloud provider has not been checked yet"),
+	}
+}
+
+// Start runs the periodic lookup until the context is done.
+func (c *CloudChecker) Start(ctx context.Context) {
+	wait.UntilWithContext(ctx, c.check, c.period)
+}
+
+func (c *CloudChecker) check(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	_, err := c.pvLabeler.GetLabelsForVolume(ctx, c.pv)
+	if err != nil {
+		err = fmt.Errorf("error looking up health check volume: %v", err)
+		klog.ErrorS(err, "cloud provider health check failed")
+	}
+
+	c.mu.Lock()
+	c.lastErr = err
+	c.mu.Unlock()
+}
+
+// Check returns the result of the last lookup.
+func (c *CloudChecker) Check() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.lastErr
+}
@@ -0,0 +1,85 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+type fakePVLabeler struct {
+	err error
+}
+
+func (f *fakePVLabeler) GetLabelsForVolume(ctx context.Context, pv *corev1.PersistentVolume) (map[string]string, error) {
+	return nil, f.err
+}
+
+func Test_Checker(t *testing.T) {
+	testcases := []struct {
+		name         string
+		checks       map[string]error
+		expectedCode int
+	}{
+		{
+			name:         "no checks",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name: "all checks pass",
+			checks: map[string]error{
+				"tls":   nil,
+				"cloud": nil,
+			},
+			expectedCode: http.StatusOK,
+		},
+		{
+			name: "one check fails",
+			checks: map[string]error{
+				"tls":   nil,
+				"cloud": errors.New("unauthorized"),
+			},
+			expectedCode: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			checker := NewChecker()
+			for name, err := range testcase.checks {
+				err := err
+				checker.AddCheck(name, func() error { return err })
+			}
+
+			rec := httptest.NewRecorder()
+			checker.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+			if rec.Code != testcase.expectedCode {
+				t.Errorf("expected status %d, got %d: %s", testcase.expectedCode, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func Test_CloudChecker(t *testing.T) {
+	pvLabeler := &fakePVLabeler{err: errors.New("unauthorized")}
+	checker := NewCloudChecker(pvLabeler, &corev1.PersistentVolume{}, time.Hour, time.Second)
+	if err := checker.Check(); err == nil {
+		t.Error("expected error before the first check")
+	}
+
+	ctx := context.Background()
+	checker.check(ctx)
+	if err := checker.Check(); err == nil {
+		t.Error("expected error from failing cloud provider")
+	}
+
+	pvLabeler.err = nil
+	checker.check(ctx)
+	if err := checker.Check(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pmezard/go-difflib/difflib"
+	corev1 "k8s.io/api/core/v1"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+
+	"sigs.k8s.io/cloud-pv-admission-labeler/admission"
+)
+
+const (
+	outputObject = "object"
+	outputPatch  = "patch"
+	outputDiff   = "diff"
+)
+
+// runLabel implements the label command: it runs the labeling pipeline on
+// PersistentVolume manifests read from files or stdin and prints the result.
+// It returns the exit code of the command.
+func runLabel(pvLabelAdmission *admission.PVLabelAdmission, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("label", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	output := fs.String("output", outputObject, "what to print for each PersistentVolume: \"object\" for the mutated object, \"patch\" for the JSON patch or \"diff\" for a unified diff of the object's YAML")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s [flags] label [--output=object|patch|diff] [FILE...]\n\n", os.Args[0])
+		fmt.Fprintf(stderr, "Runs the labeling pipeline on the PersistentVolumes in FILEs, or stdin if none or \"-\" is given.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	switch *output {
+	case outputObject, outputPatch, outputDiff:
+	default:
+		fmt.Fprintf(stderr, "invalid --output %q, must be %q, %q or %q\n", *output, outputObject, outputPatch, outputDiff)
+		return 2
+	}
+
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	var pvs []*corev1.PersistentVolume
+	for _, file := range files {
+		var pvsInFile []*corev1.PersistentVolume
+		var err error
+		if file == "-" {
+			pvsInFile, err = decodePersistentVolumes(stdin)
+		} else {
+			pvsInFile, err = readPersistentVolumes(file)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "error reading %s: %v\n", file, err)
+			return 1
+		}
+		pvs = append(pvs, pvsInFile...)
+	}
+
+	exitCode := 0
+	for i, pv := range pvs {
+		newPV, patch, err := pvLabelAdmission.Label(context.Background(), pv)
+		if err != nil {
+			fmt.Fprintf(stderr, "error labeling PersistentVolume %s: %v\n", pv.Name, err)
+			exitCode = 1
+			continue
+		}
+
+		if err := printLabelResult(stdout, *output, i, pv, newPV, patch); err != nil {
+			fmt.Fprintf(stderr, "error printing PersistentVolume %s: %v\n", pv.Name, err)
+			exitCode = 1
+		}
+	}
+
+	return exitCode
+}
+
+func printLabelResult(w io.Writer, output string, index int, pv, newPV *corev1.PersistentVolume, patch []byte) error {
+	if output == outputPatch {
+		if len(patch) == 0 {
+			patch = []byte("[]")
+		}
+		_, err := fmt.Fprintf(w, "# PersistentVolume %s\n%s\n", pv.Name, patch)
+		return err
+	}
+
+	out, err := yaml.Marshal(newPV)
+	if err != nil {
+		return err
+	}
+
+	if output == outputDiff {
+		in, err := yaml.Marshal(pv)
+		if err != nil {
+			return err
+		}
+		// Unchanged PersistentVolumes have an empty diff
+		diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        difflib.SplitLines(string(in)),
+			B:        difflib.SplitLines(string(out)),
+			FromFile: "a/" + pv.Name + ".yaml",
+			ToFile:   "b/" + pv.Name + ".yaml",
+			Context:  3,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, diff)
+		return err
+	}
+
+	if index > 0 {
+		if _, err := fmt.Fprintln(w, "---"); err != nil {
+			return err
+		}
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+func readPersistentVolumes(path string) ([]*corev1.PersistentVolume, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return decodePersistentVolumes(f)
+}
+
+// decodePersistentVolumes decodes a stream of YAML documents or JSON objects
+// holding PersistentVolumes or lists of PersistentVolumes.
+func decodePersistentVolumes(r io.Reader) ([]*corev1.PersistentVolume, error) {
+	decoder := utilyaml.NewYAMLOrJSONDecoder(r, 4096)
+
+	var pvs []*corev1.PersistentVolume
+	for {
+		var raw map[string]interface{}
+		if err := decoder.Decode(&raw); err != nil {
+			if errors.Is(err, io.EOF) {
+				return pvs, nil
+			}
+			return nil, err
+		}
+		if len(raw) == 0 {
+			// Empty YAML document
+			continue
+		}
+
+		data, err := yaml.Marshal(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		kind, _ := raw["kind"].(string)
+		switch kind {
+		case "PersistentVolume":
+			pv := &corev1.PersistentVolume{}
+			if err := yaml.Unmarshal(data, pv); err != nil {
+				return nil, err
+			}
+			pvs = append(pvs, pv)
+		case "List", "PersistentVolumeList":
+			var pvList corev1.PersistentVolumeList
+			if err := yaml.Unmarshal(data, &pvList); err != nil {
+				return nil, err
+			}
+			for i := range pvList.Items {
+				if pvList.Items[i].Kind != "" && pvList.Items[i].Kind != "PersistentVolume" {
+					return nil, fmt.Errorf("unexpected kind %s in list, only PersistentVolumes are supported", pvList.Items[i].Kind)
+				}
+				pvs = append(pvs, &pvList.Items[i])
+			}
+		default:
+			return nil, fmt.Errorf("unexpected kind %q, only PersistentVolumes are supported", kind)
+		}
+	}
+}
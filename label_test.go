@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"sigs.k8s.io/cloud-pv-admission-labeler/admission"
+)
+
+type fakePVLabeler struct {
+	labels map[string]string
+}
+
+func (f *fakePVLabeler) GetLabelsForVolume(ctx context.Context, pv *corev1.PersistentVolume) (map[string]string, error) {
+	return f.labels, nil
+}
+
+const testPVs = `
+apiVersion: v1
+kind: PersistentVolume
+metadata:
+  name: ebs
+spec:
+  awsElasticBlockStore:
+    volumeID: vol-123
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: PersistentVolume
+  metadata:
+    name: nfs
+  spec:
+    nfs:
+      server: nfs.example.com
+      path: /export
+`
+
+func Test_decodePersistentVolumes(t *testing.T) {
+	pvs, err := decodePersistentVolumes(strings.NewReader(testPVs))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pvs) != 2 || pvs[0].Name != "ebs" || pvs[1].Name != "nfs" {
+		t.Fatalf("unexpected PVs: %v", pvs)
+	}
+	if pvs[0].Spec.AWSElasticBlockStore == nil || pvs[0].Spec.AWSElasticBlockStore.VolumeID != "vol-123" {
+		t.Errorf("unexpected volume source: %v", pvs[0].Spec.PersistentVolumeSource)
+	}
+
+	if _, err := decodePersistentVolumes(strings.NewReader("kind: Pod\n")); err == nil {
+		t.Error("expected error decoding a Pod")
+	}
+}
+
+func Test_runLabel(t *testing.T) {
+	pvLabeler := &fakePVLabeler{
+		labels: map[string]string{
+			corev1.LabelTopologyZone:   "us-east-1a",
+			corev1.LabelTopologyRegion: "us-east-1",
+		},
+	}
+	pvLabelAdmission := admission.NewPVLabelAdmission("aws", runtime.NewScheme(), pvLabeler, admission.Options{})
+
+	testcases := []struct {
+		name             string
+		args             []string
+		expectedExitCode int
+		expectedOutput   []string
+	}{
+		{
+			name:             "object",
+			args:             []string{"--output=object"},
+			expectedExitCode: 0,
+			expectedOutput:   []string{"topology.kubernetes.io/zone: us-east-1a", "name: nfs"},
+		},
+		{
+			name:             "patch",
+			args:             []string{"--output=patch"},
+			expectedExitCode: 0,
+			expectedOutput:   []string{"# PersistentVolume ebs", `"op":"add"`, "# PersistentVolume nfs\n[]"},
+		},
+		{
+			name:             "diff",
+			args:             []string{"--output=diff", "-"},
+			expectedExitCode: 0,
+			expectedOutput:   []string{"--- a/ebs.yaml\n+++ b/ebs.yaml\n@@ ", "\n+    topology.kubernetes.io/region: us-east-1\n"},
+		},
+		{
+			name:             "invalid output",
+			args:             []string{"--output=table"},
+			expectedExitCode: 2,
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			exitCode := runLabel(pvLabelAdmission, testcase.args, strings.NewReader(testPVs), &stdout, &stderr)
+			if exitCode != testcase.expectedExitCode {
+				t.Errorf("expected exit code %d, got %d: %s", testcase.expectedExitCode, exitCode, stderr.String())
+			}
+			for _, expected := range testcase.expectedOutput {
+				if !strings.Contains(stdout.String(), expected) {
+					t.Errorf("expected output to contain %q, got:\n%s", expected, stdout.String())
+				}
+			}
+		})
+	}
+}
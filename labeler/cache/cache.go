@@ -0,0 +1,245 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+	corev1 "k8s.io/api/core/v1"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/utils/clock"
+
+	"sigs.k8s.io/cloud-pv-admission-labeler/labeler"
+	"sigs.k8s.io/cloud-pv-admission-labeler/metrics"
+)
+
+// snapshotMaxAge is how long the labels of a volume are kept in the snapshot
+// after they were last looked up, so that the snapshot does not grow with
+// every volume ever looked up, including deleted ones.
+const snapshotMaxAge = 7 * 24 * time.Hour
+
+type entry struct {
+	labels  map[string]string
+	err     error
+	expires time.Time
+}
+
+// lookup is the result of a lookup shared by the callers of
+// GetLabelsForVolume, with whether it was stored by the caller that started it.
+type lookup struct {
+	labels map[string]string
+	stored bool
+}
+
+type snapshotEntry struct {
+	labels  map[string]string
+	updated time.Time
+}
+
+// Labeler is a cloudprovider.PVLabeler caching the labels returned by another
+// PVLabeler, keyed by the identity of the volume. Concurrent lookups of the
+// same volume share a single call and failed lookups are cached for a shorter
+// time so that a missing volume is not looked up repeatedly.
+type Labeler struct {
+	provider    string
+	pvLabeler   cloudprovider.PVLabeler
+	ttl         time.Duration
+	negativeTTL time.Duration
+	clock       clock.PassiveClock
+
+	group singleflight.Group
+
+	mu        sync.Mutex
+	entries   map[string]entry
+	lastSweep time.Time
+	// snapshot holds the last labels successfully looked up for every
+	// volume, kept after their entry expires for up to snapshotMaxAge.
+	snapshot map[string]snapshotEntry
+}
+
+var _ cloudprovider.PVLabeler = &Labeler{}
+
+// New returns a Labeler caching the labels returned by pvLabeler for ttl and
+// its errors for negativeTTL. A negativeTTL of zero disables negative caching.
+func New(provider string, pvLabeler cloudprovider.PVLabeler, ttl, negativeTTL time.Duration) *Labeler {
+	return newWithClock(provider, pvLabeler, ttl, negativeTTL, clock.RealClock{})
+}
+
+func newWithClock(provider string, pvLabeler cloudprovider.PVLabeler, ttl, negativeTTL time.Duration, clock clock.PassiveClock) *Labeler {
+	return &Labeler{
+		provider:    provider,
+		pvLabeler:   pvLabeler,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		clock:       clock,
+		entries:     make(map[string]entry),
+		lastSweep:   clock.Now(),
+		snapshot:    make(map[string]snapshotEntry),
+	}
+}
+
+// GetLabelsForVolume returns the cached labels of the PV's volume, looking
+// them up from the wrapped PVLabeler if they are not cached. The labels looked
+// up for dry-run requests are not cached, unless other requests shared the
+// lookup.
+func (c *Labeler) GetLabelsForVolume(ctx context.Context, pv *corev1.PersistentVolume) (map[string]string, error) {
+	key, ok := VolumeKey(pv)
+	if !ok {
+		return c.pvLabeler.GetLabelsForVolume(ctx, pv)
+	}
+	key = c.provider + "/" + key
+
+	c.mu.Lock()
+	e, found := c.entries[key]
+	if found && c.clock.Now().After(e.expires) {
+		delete(c.entries, key)
+		found = false
+	}
+	c.mu.Unlock()
+
+	if found {
+		if e.err != nil {
+			metrics.RecordCacheRequest(c.provider, metrics.CacheNegativeHit)
+			return nil, e.err
+		}
+		metrics.RecordCacheRequest(c.provider, metrics.CacheHit)
+		return copyLabels(e.labels), nil
+	}
+
+	resultCh := c.group.DoChan(key, func() (interface{}, error) {
+		// The lookup is shared with other callers, so it must not be
+		// cancelled when the caller that started it goes away.
+		lookupCtx := context.WithoutCancel(ctx)
+		if deadline, ok := ctx.Deadline(); ok {
+			var cancel context.CancelFunc
+			lookupCtx, cancel = context.WithDeadline(lookupCtx, deadline)
+			defer cancel()
+		}
+
+		labels, err := c.pvLabeler.GetLabelsForVolume(lookupCtx, pv)
+		stored := !labeler.IsDryRun(ctx)
+		if stored {
+			c.store(key, labels, err)
+		}
+		return lookup{labels: labels, stored: stored}, err
+	})
+
+	select {
+	case res := <-resultCh:
+		if res.Shared {
+			metrics.RecordCacheRequest(c.provider, metrics.CacheCoalesced)
+		} else {
+			metrics.RecordCacheRequest(c.provider, metrics.CacheMiss)
+		}
+		result := res.Val.(lookup)
+		if !result.stored && !labeler.IsDryRun(ctx) {
+			// The lookup was started by a dry-run request
+			c.store(key, result.labels, res.Err)
+		}
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return copyLabels(result.labels), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Labeler) store(key string, labels map[string]string, err error) {
+	ttl := c.ttl
+	if err != nil {
+		// Do not cache lookups that were cut short
+		if c.negativeTTL <= 0 || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		ttl = c.negativeTTL
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock.Now()
+	if now.Sub(c.lastSweep) > c.ttl {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k, e := range c.snapshot {
+			if now.Sub(e.updated) > snapshotMaxAge {
+				delete(c.snapshot, k)
+			}
+		}
+		c.lastSweep = now
+	}
+
+	c.entries[key] = entry{
+		labels:  copyLabels(labels),
+		err:     err,
+		expires: now.Add(ttl),
+	}
+	if err == nil {
+		c.snapshot[key] = snapshotEntry{labels: copyLabels(labels), updated: now}
+	}
+}
+
+// Snapshot returns a PVLabeler returning the labels last looked up for the
+// PV's volume, up to a week ago, without calling the wrapped PVLabeler. It
+// returns an error for volumes that were not looked up successfully since.
+func (c *Labeler) Snapshot() cloudprovider.PVLabeler {
+	return snapshot{c}
+}
+
+type snapshot struct {
+	c *Labeler
+}
+
+func (s snapshot) GetLabelsForVolume(ctx context.Context, pv *corev1.PersistentVolume) (map[string]string, error) {
+	key, ok := VolumeKey(pv)
+	if !ok {
+		return nil, nil
+	}
+
+	s.c.mu.Lock()
+	e, ok := s.c.snapshot[s.c.provider+"/"+key]
+	s.c.mu.Unlock()
+	if !ok || s.c.clock.Now().Sub(e.updated) > snapshotMaxAge {
+		return nil, fmt.Errorf("volume %s was not looked up from cloud provider %s in the last %v", key, s.c.provider, snapshotMaxAge)
+	}
+	return copyLabels(e.labels), nil
+}
+
+// VolumeKey returns a key identifying the volume backing the PV, or false if
+// the PV's volume source is not one that can be cached.
+func VolumeKey(pv *corev1.PersistentVolume) (string, bool) {
+	switch {
+	case pv.Spec.GCEPersistentDisk != nil:
+		// The zone labels are a hint used to find the disk, so they are part of the key.
+		zone := pv.Labels[corev1.LabelTopologyZone]
+		if zone == "" {
+			zone = pv.Labels[corev1.LabelFailureDomainBetaZone]
+		}
+		return "gce-pd/" + zone + "/" + pv.Spec.GCEPersistentDisk.PDName, true
+	case pv.Spec.AWSElasticBlockStore != nil:
+		return "aws-ebs/" + pv.Spec.AWSElasticBlockStore.VolumeID, true
+	case pv.Spec.AzureDisk != nil:
+		return "azure-disk/" + pv.Spec.AzureDisk.DataDiskURI, true
+	case pv.Spec.VsphereVolume != nil:
+		return "vsphere-volume/" + pv.Spec.VsphereVolume.VolumePath, true
+	}
+	return "", false
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+	}
+	return copied
+}
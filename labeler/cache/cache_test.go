@@ -0,0 +1,276 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	testingclock "k8s.io/utils/clock/testing"
+
+	"sigs.k8s.io/cloud-pv-admission-labeler/labeler"
+)
+
+type fakePVLabeler struct {
+	labels  map[string]string
+	err     error
+	calls   int32
+	release chan struct{}
+}
+
+func (f *fakePVLabeler) GetLabelsForVolume(ctx context.Context, pv *corev1.PersistentVolume) (map[string]string, error) {
+	atomic.AddInt32(&f.calls, 1)
+	if f.release != nil {
+		<-f.release
+	}
+	return f.labels, f.err
+}
+
+func ebsPV(volumeID string) *corev1.PersistentVolume {
+	return &corev1.PersistentVolume{
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				AWSElasticBlockStore: &corev1.AWSElasticBlockStoreVolumeSource{
+					VolumeID: volumeID,
+				},
+			},
+		},
+	}
+}
+
+func Test_LabelerCachesLabels(t *testing.T) {
+	fakeClock := testingclock.NewFakePassiveClock(time.Now())
+	pvLabeler := &fakePVLabeler{
+		labels: map[string]string{corev1.LabelTopologyZone: "us-east-1a"},
+	}
+	labeler := newWithClock("aws", pvLabeler, time.Minute, 10*time.Second, fakeClock)
+
+	for i := 0; i < 3; i++ {
+		labels, err := labeler.GetLabelsForVolume(context.Background(), ebsPV("vol-1"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(labels, pvLabeler.labels) {
+			t.Errorf("unexpected labels: %v", labels)
+		}
+	}
+	if calls := atomic.LoadInt32(&pvLabeler.calls); calls != 1 {
+		t.Errorf("expected 1 cloud call, got %d", calls)
+	}
+
+	// A different volume is looked up separately.
+	if _, err := labeler.GetLabelsForVolume(context.Background(), ebsPV("vol-2")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls := atomic.LoadInt32(&pvLabeler.calls); calls != 2 {
+		t.Errorf("expected 2 cloud calls, got %d", calls)
+	}
+
+	// Expired entries are looked up again.
+	fakeClock.SetTime(fakeClock.Now().Add(2 * time.Minute))
+	if _, err := labeler.GetLabelsForVolume(context.Background(), ebsPV("vol-1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls := atomic.LoadInt32(&pvLabeler.calls); calls != 3 {
+		t.Errorf("expected 3 cloud calls, got %d", calls)
+	}
+}
+
+func Test_LabelerNegativeCaching(t *testing.T) {
+	fakeClock := testingclock.NewFakePassiveClock(time.Now())
+	pvLabeler := &fakePVLabeler{err: errors.New("volume not found")}
+	labeler := newWithClock("aws", pvLabeler, time.Minute, 10*time.Second, fakeClock)
+
+	for i := 0; i < 2; i++ {
+		if _, err := labeler.GetLabelsForVolume(context.Background(), ebsPV("vol-1")); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+	if calls := atomic.LoadInt32(&pvLabeler.calls); calls != 1 {
+		t.Errorf("expected 1 cloud call, got %d", calls)
+	}
+
+	fakeClock.SetTime(fakeClock.Now().Add(11 * time.Second))
+	if _, err := labeler.GetLabelsForVolume(context.Background(), ebsPV("vol-1")); err == nil {
+		t.Fatal("expected error")
+	}
+	if calls := atomic.LoadInt32(&pvLabeler.calls); calls != 2 {
+		t.Errorf("expected 2 cloud calls, got %d", calls)
+	}
+}
+
+func Test_LabelerDryRun(t *testing.T) {
+	fakeClock := testingclock.NewFakePassiveClock(time.Now())
+	pvLabeler := &fakePVLabeler{
+		labels: map[string]string{corev1.LabelTopologyZone: "us-east-1a"},
+	}
+	cache := newWithClock("aws", pvLabeler, time.Minute, 10*time.Second, fakeClock)
+
+	dryRunCtx := labeler.WithDryRun(context.Background())
+	for i := 0; i < 2; i++ {
+		labels, err := cache.GetLabelsForVolume(dryRunCtx, ebsPV("vol-1"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(labels, pvLabeler.labels) {
+			t.Errorf("unexpected labels: %v", labels)
+		}
+	}
+	if calls := atomic.LoadInt32(&pvLabeler.calls); calls != 2 {
+		t.Errorf("expected 2 cloud calls, got %d", calls)
+	}
+
+	// Dry-run requests still use the labels cached by other requests.
+	if _, err := cache.GetLabelsForVolume(context.Background(), ebsPV("vol-1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := cache.GetLabelsForVolume(dryRunCtx, ebsPV("vol-1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls := atomic.LoadInt32(&pvLabeler.calls); calls != 3 {
+		t.Errorf("expected 3 cloud calls, got %d", calls)
+	}
+}
+
+func Test_LabelerSnapshot(t *testing.T) {
+	fakeClock := testingclock.NewFakePassiveClock(time.Now())
+	pvLabeler := &fakePVLabeler{
+		labels: map[string]string{corev1.LabelTopologyZone: "us-east-1a"},
+	}
+	cache := newWithClock("aws", pvLabeler, time.Minute, 10*time.Second, fakeClock)
+	snapshot := cache.Snapshot()
+
+	if _, err := snapshot.GetLabelsForVolume(context.Background(), ebsPV("vol-1")); err == nil {
+		t.Fatal("expected error for volume that was never looked up")
+	}
+	if _, err := cache.GetLabelsForVolume(context.Background(), ebsPV("vol-1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The snapshot is kept after the entry expires and lookups fail.
+	fakeClock.SetTime(fakeClock.Now().Add(2 * time.Minute))
+	pvLabeler.labels, pvLabeler.err = nil, errors.New("service unavailable")
+	if _, err := cache.GetLabelsForVolume(context.Background(), ebsPV("vol-1")); err == nil {
+		t.Fatal("expected error")
+	}
+	labels, err := snapshot.GetLabelsForVolume(context.Background(), ebsPV("vol-1"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := map[string]string{corev1.LabelTopologyZone: "us-east-1a"}; !reflect.DeepEqual(labels, expected) {
+		t.Errorf("expected labels %v, got %v", expected, labels)
+	}
+	if calls := atomic.LoadInt32(&pvLabeler.calls); calls != 2 {
+		t.Errorf("expected 2 cloud calls, got %d", calls)
+	}
+}
+
+func Test_LabelerSnapshotExpires(t *testing.T) {
+	fakeClock := testingclock.NewFakePassiveClock(time.Now())
+	pvLabeler := &fakePVLabeler{
+		labels: map[string]string{corev1.LabelTopologyZone: "us-east-1a"},
+	}
+	cache := newWithClock("aws", pvLabeler, time.Minute, 0, fakeClock)
+	snapshot := cache.Snapshot()
+
+	if _, err := cache.GetLabelsForVolume(context.Background(), ebsPV("vol-1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Volumes that were not looked up for longer than snapshotMaxAge, e.g.
+	// deleted ones, are dropped from the snapshot.
+	fakeClock.SetTime(fakeClock.Now().Add(snapshotMaxAge + time.Minute))
+	if _, err := snapshot.GetLabelsForVolume(context.Background(), ebsPV("vol-1")); err == nil {
+		t.Error("expected error for volume looked up too long ago")
+	}
+	if _, err := cache.GetLabelsForVolume(context.Background(), ebsPV("vol-2")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cache.mu.Lock()
+	_, found := cache.snapshot["aws/aws-ebs/vol-1"]
+	size := len(cache.snapshot)
+	cache.mu.Unlock()
+	if found || size != 1 {
+		t.Errorf("expected expired volume to be evicted from the snapshot, got %d volumes", size)
+	}
+}
+
+func Test_LabelerDryRunSharedLookup(t *testing.T) {
+	pvLabeler := &fakePVLabeler{
+		labels:  map[string]string{corev1.LabelTopologyZone: "us-east-1a"},
+		release: make(chan struct{}),
+	}
+	cache := New("aws", pvLabeler, time.Minute, 0)
+
+	// A dry-run request starts the lookup, which a regular request joins.
+	var wg sync.WaitGroup
+	for _, ctx := range []context.Context{labeler.WithDryRun(context.Background()), context.Background()} {
+		wg.Add(1)
+		go func(ctx context.Context) {
+			defer wg.Done()
+			if _, err := cache.GetLabelsForVolume(ctx, ebsPV("vol-1")); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}(ctx)
+		for atomic.LoadInt32(&pvLabeler.calls) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(pvLabeler.release)
+	wg.Wait()
+
+	// The labels are cached for the regular request.
+	if _, err := cache.GetLabelsForVolume(context.Background(), ebsPV("vol-1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls := atomic.LoadInt32(&pvLabeler.calls); calls != 1 {
+		t.Errorf("expected 1 cloud call, got %d", calls)
+	}
+}
+
+func Test_LabelerCoalescesLookups(t *testing.T) {
+	pvLabeler := &fakePVLabeler{
+		labels:  map[string]string{corev1.LabelTopologyZone: "us-east-1a"},
+		release: make(chan struct{}),
+	}
+	labeler := New("aws", pvLabeler, time.Minute, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := labeler.GetLabelsForVolume(context.Background(), ebsPV("vol-1")); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+
+	// Wait for the first lookup to start before letting it finish.
+	for atomic.LoadInt32(&pvLabeler.calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(pvLabeler.release)
+	wg.Wait()
+
+	if calls := atomic.LoadInt32(&pvLabeler.calls); calls != 1 {
+		t.Errorf("expected 1 cloud call, got %d", calls)
+	}
+}
+
+func Test_VolumeKey(t *testing.T) {
+	if _, ok := VolumeKey(&corev1.PersistentVolume{}); ok {
+		t.Error("expected no key for PV without a supported volume source")
+	}
+
+	key, ok := VolumeKey(ebsPV("vol-1"))
+	if !ok || key != "aws-ebs/vol-1" {
+		t.Errorf("unexpected key %q", key)
+	}
+}
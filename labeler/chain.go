@@ -0,0 +1,117 @@
+package labeler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/klog/v2"
+)
+
+// Source is a named source of labels in a Chain.
+type Source struct {
+	Name    string
+	Labeler cloudprovider.PVLabeler
+	// Timeout bounds the lookups of the source so that the next sources
+	// can still be asked if it hangs. Zero means no timeout besides the
+	// caller's own.
+	Timeout time.Duration
+}
+
+// SourceLabeler is implemented by PVLabelers reporting where the labels of a
+// volume come from, e.g. which source of a Chain supplied them.
+type SourceLabeler interface {
+	GetLabelsAndSourceForVolume(ctx context.Context, pv *corev1.PersistentVolume) (map[string]string, string, error)
+}
+
+// Chain is a cloudprovider.PVLabeler asking its sources in order for the
+// labels of a volume. The first source returning labels wins, so that a
+// degraded source does not prevent volumes from being labeled.
+type Chain struct {
+	sources []Source
+}
+
+var (
+	_ cloudprovider.PVLabeler = &Chain{}
+	_ SourceLabeler           = &Chain{}
+)
+
+// NewChain returns a Chain of the sources, by decreasing priority.
+func NewChain(sources ...Source) *Chain {
+	return &Chain{sources: sources}
+}
+
+// GetLabelsForVolume returns the labels of the first source that has labels
+// for the PV's volume.
+func (c *Chain) GetLabelsForVolume(ctx context.Context, pv *corev1.PersistentVolume) (map[string]string, error) {
+	labels, _, err := c.GetLabelsAndSourceForVolume(ctx, pv)
+	return labels, err
+}
+
+// GetLabelsAndSourceForVolume returns the labels of the first source that has
+// labels for the PV's volume and the name of that source, followed by the
+// source reported by the source's own labeler if it is a SourceLabeler, e.g.
+// "inference/storage-class". Sources failing or
+// returning no labels are skipped. The errors of the sources are returned if
+// none of them has labels and at least one failed.
+func (c *Chain) GetLabelsAndSourceForVolume(ctx context.Context, pv *corev1.PersistentVolume) (map[string]string, string, error) {
+	var errs []error
+	for _, source := range c.sources {
+		if ctx.Err() != nil {
+			// Leave the remaining sources out rather than failing all of them
+			errs = append(errs, ctx.Err())
+			break
+		}
+
+		labels, innerSource, err := source.getLabels(ctx, pv)
+		if err != nil {
+			klog.ErrorS(err, "Failed to get volume labels from source, trying the next one", "source", source.Name, "pv", klog.KObj(pv))
+			errs = append(errs, fmt.Errorf("%s: %w", source.Name, err))
+			continue
+		}
+		if len(labels) > 0 {
+			if innerSource != "" {
+				return labels, source.Name + "/" + innerSource, nil
+			}
+			return labels, source.Name, nil
+		}
+	}
+	return nil, "", errors.Join(errs...)
+}
+
+// getLabels looks up the labels of the PV's volume from the source within its
+// timeout. Not all PVLabelers honor the context, so the lookup is abandoned
+// once the context is done even if the source is still running.
+func (s Source) getLabels(ctx context.Context, pv *corev1.PersistentVolume) (map[string]string, string, error) {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+
+	type result struct {
+		labels map[string]string
+		source string
+		err    error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		if sourceLabeler, ok := s.Labeler.(SourceLabeler); ok {
+			labels, source, err := sourceLabeler.GetLabelsAndSourceForVolume(ctx, pv)
+			resultCh <- result{labels: labels, source: source, err: err}
+			return
+		}
+		labels, err := s.Labeler.GetLabelsForVolume(ctx, pv)
+		resultCh <- result{labels: labels, err: err}
+	}()
+
+	select {
+	case res := <-resultCh:
+		return res.labels, res.source, res.err
+	case <-ctx.Done():
+		return nil, "", ctx.Err()
+	}
+}
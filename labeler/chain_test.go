@@ -0,0 +1,130 @@
+package labeler
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+type fakePVLabeler struct {
+	labels map[string]string
+	err    error
+	delay  time.Duration
+}
+
+func (f *fakePVLabeler) GetLabelsForVolume(ctx context.Context, pv *corev1.PersistentVolume) (map[string]string, error) {
+	time.Sleep(f.delay)
+	return f.labels, f.err
+}
+
+type fakeSourceLabeler struct {
+	fakePVLabeler
+	source string
+}
+
+func (f *fakeSourceLabeler) GetLabelsAndSourceForVolume(ctx context.Context, pv *corev1.PersistentVolume) (map[string]string, string, error) {
+	labels, err := f.GetLabelsForVolume(ctx, pv)
+	return labels, f.source, err
+}
+
+func Test_Chain(t *testing.T) {
+	cloudLabels := map[string]string{corev1.LabelTopologyZone: "us-east-1a"}
+	staticLabels := map[string]string{corev1.LabelTopologyZone: "us-east-1b"}
+
+	testcases := []struct {
+		name           string
+		sources        []Source
+		expectedLabels map[string]string
+		expectedSource string
+		expectedErr    string
+	}{
+		{
+			name: "first source answers",
+			sources: []Source{
+				{Name: "cloud", Labeler: &fakePVLabeler{labels: cloudLabels}},
+				{Name: "static", Labeler: &fakePVLabeler{labels: staticLabels}},
+			},
+			expectedLabels: cloudLabels,
+			expectedSource: "cloud",
+		},
+		{
+			name: "first source fails",
+			sources: []Source{
+				{Name: "cloud", Labeler: &fakePVLabeler{err: errors.New("service unavailable")}},
+				{Name: "static", Labeler: &fakePVLabeler{labels: staticLabels}},
+			},
+			expectedLabels: staticLabels,
+			expectedSource: "static",
+		},
+		{
+			name: "first source times out",
+			sources: []Source{
+				{Name: "cloud", Labeler: &fakePVLabeler{labels: cloudLabels, delay: time.Second}, Timeout: 10 * time.Millisecond},
+				{Name: "static", Labeler: &fakePVLabeler{labels: staticLabels}},
+			},
+			expectedLabels: staticLabels,
+			expectedSource: "static",
+		},
+		{
+			name: "first source has no labels",
+			sources: []Source{
+				{Name: "cloud", Labeler: &fakePVLabeler{}},
+				{Name: "static", Labeler: &fakePVLabeler{labels: staticLabels}},
+			},
+			expectedLabels: staticLabels,
+			expectedSource: "static",
+		},
+		{
+			name: "source reporting its own source",
+			sources: []Source{
+				{Name: "cloud", Labeler: &fakePVLabeler{}},
+				{Name: "inference", Labeler: &fakeSourceLabeler{fakePVLabeler: fakePVLabeler{labels: staticLabels}, source: "storage-class"}},
+			},
+			expectedLabels: staticLabels,
+			expectedSource: "inference/storage-class",
+		},
+		{
+			name: "no source has labels",
+			sources: []Source{
+				{Name: "cloud", Labeler: &fakePVLabeler{}},
+			},
+		},
+		{
+			name: "all sources fail",
+			sources: []Source{
+				{Name: "cloud", Labeler: &fakePVLabeler{err: errors.New("service unavailable")}},
+				{Name: "static", Labeler: &fakePVLabeler{err: errors.New("no zone mapped")}},
+			},
+			expectedErr: "cloud: service unavailable\nstatic: no zone mapped",
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			chain := NewChain(testcase.sources...)
+			labels, source, err := chain.GetLabelsAndSourceForVolume(context.Background(), &corev1.PersistentVolume{})
+			if testcase.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), testcase.expectedErr) {
+					t.Fatalf("expected error %q, got %v", testcase.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(labels, testcase.expectedLabels) {
+				t.Logf("actual labels: %v", labels)
+				t.Logf("expected labels: %v", testcase.expectedLabels)
+				t.Error("unexpected labels")
+			}
+			if source != testcase.expectedSource {
+				t.Errorf("expected source %q, got %q", testcase.expectedSource, source)
+			}
+		})
+	}
+}
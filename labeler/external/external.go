@@ -0,0 +1,186 @@
+// Package external implements a cloudprovider.PVLabeler looking up the labels
+// of volumes from an external labeler, e.g. a sidecar or a remote service, so
+// that storage platforms without an in-tree cloud provider can be labeled.
+//
+// The protocol is plain JSON over HTTP. A LabelRequest is POSTed to the
+// labeler's endpoint, which answers with a LabelResponse: with status 200 and
+// the labels of the volume, which may be empty if it does not know the volume,
+// or with an error status and the Error field set if the lookup failed.
+package external
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	cloudprovider "k8s.io/cloud-provider"
+
+	"sigs.k8s.io/cloud-pv-admission-labeler/labeler"
+)
+
+const (
+	// APIVersion is the version of the protocol implemented by this package.
+	APIVersion = "labeler.cloud-pv-labeler.k8s.io/v1alpha1"
+
+	// KindLabelRequest and KindLabelResponse are the kinds of the messages.
+	KindLabelRequest  = "LabelRequest"
+	KindLabelResponse = "LabelResponse"
+)
+
+// maxResponseSize bounds the size of the responses read from the labeler.
+const maxResponseSize = 1 << 20
+
+// LabelRequest asks the external labeler for the labels of a PV's volume.
+type LabelRequest struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// Timeout is how long the labeler has to respond before the lookup is
+	// abandoned.
+	Timeout metav1.Duration `json:"timeout"`
+	// DryRun is set if the PV is part of a dry-run request, the labeler must
+	// not have any side effects then.
+	DryRun bool `json:"dryRun,omitempty"`
+	// PersistentVolume is the PV whose volume is looked up.
+	PersistentVolume *corev1.PersistentVolume `json:"persistentVolume"`
+}
+
+// LabelResponse returns the labels of the PV's volume.
+type LabelResponse struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// Labels are the topology labels of the volume.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Error explains why the labels could not be looked up.
+	Error string `json:"error,omitempty"`
+}
+
+// Config configures the Labeler.
+type Config struct {
+	// Timeout bounds every request to the external labeler. Defaults to 5s.
+	Timeout time.Duration
+	// CAFile is the path to the CA bundle used to verify an https endpoint,
+	// the system roots are used if empty.
+	CAFile string
+}
+
+// Labeler is a cloudprovider.PVLabeler calling an external labeler.
+type Labeler struct {
+	url     string
+	client  *http.Client
+	timeout time.Duration
+}
+
+var _ cloudprovider.PVLabeler = &Labeler{}
+
+// New returns a Labeler calling the external labeler at the endpoint, either
+// an http or https URL or, for a sidecar, unix:///path/to/socket.
+func New(endpoint string, config Config) (*Labeler, error) {
+	if config.Timeout <= 0 {
+		config.Timeout = 5 * time.Second
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid external labeler endpoint %q: %v", endpoint, err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	switch u.Scheme {
+	case "http", "https":
+	case "unix":
+		socket := u.Path
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		endpoint = "http://external-labeler/"
+	default:
+		return nil, fmt.Errorf("invalid external labeler endpoint %q: scheme must be http, https or unix", endpoint)
+	}
+
+	if config.CAFile != "" {
+		ca, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading external labeler CA file %s: %v", config.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in external labeler CA file %s", config.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: pool}
+	}
+
+	return &Labeler{
+		url:     endpoint,
+		client:  &http.Client{Transport: transport, Timeout: config.Timeout},
+		timeout: config.Timeout,
+	}, nil
+}
+
+// GetLabelsForVolume looks up the labels of the PV's volume from the external
+// labeler.
+func (l *Labeler) GetLabelsForVolume(ctx context.Context, pv *corev1.PersistentVolume) (map[string]string, error) {
+	timeout := l.timeout
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+
+	body, err := json.Marshal(&LabelRequest{
+		TypeMeta:         metav1.TypeMeta{APIVersion: APIVersion, Kind: KindLabelRequest},
+		Timeout:          metav1.Duration{Duration: timeout},
+		DryRun:           labeler.IsDryRun(ctx),
+		PersistentVolume: pv,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error encoding external labeler request: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, l.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error calling external labeler: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("error reading external labeler response: %w", err)
+	}
+
+	labelResponse := &LabelResponse{}
+	if err := json.Unmarshal(data, labelResponse); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("external labeler returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+		}
+		return nil, fmt.Errorf("error decoding external labeler response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if labelResponse.Error == "" {
+			labelResponse.Error = http.StatusText(resp.StatusCode)
+		}
+		return nil, fmt.Errorf("external labeler returned %s: %s", resp.Status, labelResponse.Error)
+	}
+	if labelResponse.APIVersion != APIVersion || labelResponse.Kind != KindLabelResponse {
+		return nil, fmt.Errorf("unexpected external labeler response %s %s, expected %s %s",
+			labelResponse.APIVersion, labelResponse.Kind, APIVersion, KindLabelResponse)
+	}
+
+	return labelResponse.Labels, nil
+}
@@ -0,0 +1,150 @@
+package external_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"sigs.k8s.io/cloud-pv-admission-labeler/labeler"
+	"sigs.k8s.io/cloud-pv-admission-labeler/labeler/external"
+	"sigs.k8s.io/cloud-pv-admission-labeler/labeler/external/externaltest"
+)
+
+func newPV(name string) *corev1.PersistentVolume {
+	return &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: "storage.example.com", VolumeHandle: name},
+			},
+		},
+	}
+}
+
+func Test_Labeler(t *testing.T) {
+	zoneA := map[string]string{corev1.LabelTopologyZone: "zone-a"}
+	server := externaltest.NewServer(map[string]map[string]string{"labeled": zoneA})
+	defer server.Close()
+	server.SetError("broken", "volume not found")
+
+	pvLabeler, err := external.New(server.URL, external.Config{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	testcases := []struct {
+		name           string
+		ctx            context.Context
+		pv             string
+		expectedLabels map[string]string
+		expectedErr    string
+	}{
+		{
+			name:           "labeled volume",
+			ctx:            context.Background(),
+			pv:             "labeled",
+			expectedLabels: zoneA,
+		},
+		{
+			name: "unknown volume",
+			ctx:  context.Background(),
+			pv:   "unknown",
+		},
+		{
+			name:           "dry-run",
+			ctx:            labeler.WithDryRun(context.Background()),
+			pv:             "labeled",
+			expectedLabels: zoneA,
+		},
+		{
+			name:        "lookup error",
+			ctx:         context.Background(),
+			pv:          "broken",
+			expectedErr: "volume not found",
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			labels, err := pvLabeler.GetLabelsForVolume(testcase.ctx, newPV(testcase.pv))
+			if testcase.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), testcase.expectedErr) {
+					t.Fatalf("expected error containing %q, got %v", testcase.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(labels, testcase.expectedLabels) {
+				t.Logf("actual labels: %v", labels)
+				t.Logf("expected labels: %v", testcase.expectedLabels)
+				t.Error("unexpected labels")
+			}
+
+			requests := server.Requests()
+			if last := requests[len(requests)-1]; last.PV != testcase.pv || last.DryRun != labeler.IsDryRun(testcase.ctx) {
+				t.Errorf("unexpected request %+v", last)
+			}
+		})
+	}
+}
+
+func Test_LabelerTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	pvLabeler, err := external.New(server.URL, external.Config{Timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := pvLabeler.GetLabelsForVolume(context.Background(), newPV("slow")); err == nil {
+		t.Fatal("expected timeout error")
+	}
+}
+
+func Test_LabelerUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "labeler.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	zoneA := map[string]string{corev1.LabelTopologyZone: "zone-a"}
+	server := httptest.NewUnstartedServer(external.NewHandler(&staticLabeler{labels: zoneA}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	pvLabeler, err := external.New("unix://"+socket, external.Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	labels, err := pvLabeler.GetLabelsForVolume(context.Background(), newPV("labeled"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(labels, zoneA) {
+		t.Errorf("expected labels %v, got %v", zoneA, labels)
+	}
+}
+
+type staticLabeler struct {
+	labels map[string]string
+}
+
+func (s *staticLabeler) GetLabelsForVolume(ctx context.Context, pv *corev1.PersistentVolume) (map[string]string, error) {
+	return s.labels, nil
+}
@@ -0,0 +1,72 @@
+// Package externaltest provides a stub external labeler for tests.
+package externaltest
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"sigs.k8s.io/cloud-pv-admission-labeler/labeler"
+	"sigs.k8s.io/cloud-pv-admission-labeler/labeler/external"
+)
+
+// Server is an external labeler returning fixed labels for each PV, indexed by
+// PV name. PVs without labels get an empty response.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	labels   map[string]map[string]string
+	errs     map[string]string
+	requests []Request
+}
+
+// Request records a request received by the Server.
+type Request struct {
+	PV     string
+	DryRun bool
+}
+
+// NewServer starts a Server returning the given labels.
+func NewServer(labels map[string]map[string]string) *Server {
+	s := &Server{
+		labels: labels,
+		errs:   make(map[string]string),
+	}
+	s.Server = httptest.NewServer(external.NewHandler(stubLabeler{s}))
+	return s
+}
+
+// SetError makes the Server fail the lookups of the PV with the message.
+func (s *Server) SetError(pv, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.errs[pv] = message
+}
+
+// Requests returns the requests received by the Server.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Request(nil), s.requests...)
+}
+
+type stubLabeler struct {
+	s *Server
+}
+
+func (l stubLabeler) GetLabelsForVolume(ctx context.Context, pv *corev1.PersistentVolume) (map[string]string, error) {
+	l.s.mu.Lock()
+	defer l.s.mu.Unlock()
+
+	l.s.requests = append(l.s.requests, Request{PV: pv.Name, DryRun: labeler.IsDryRun(ctx)})
+	if message, ok := l.s.errs[pv.Name]; ok {
+		return nil, errors.New(message)
+	}
+	return l.s.labels[pv.Name], nil
+}
@@ -0,0 +1,89 @@
+package external
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/cloud-pv-admission-labeler/labeler"
+)
+
+// maxRequestSize bounds the size of the requests read by the Handler.
+const maxRequestSize = 3 << 20
+
+// NewHandler returns a reference implementation of the external labeler
+// protocol, serving the labels returned by pvLabeler.
+func NewHandler(pvLabeler cloudprovider.PVLabeler) http.Handler {
+	return &handler{pvLabeler: pvLabeler}
+}
+
+type handler struct {
+	pvLabeler cloudprovider.PVLabeler
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeResponse(w, http.StatusMethodNotAllowed, nil, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxRequestSize))
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, nil, fmt.Errorf("error reading request: %v", err))
+		return
+	}
+	request := &LabelRequest{}
+	if err := json.Unmarshal(data, request); err != nil {
+		writeResponse(w, http.StatusBadRequest, nil, fmt.Errorf("error decoding request: %v", err))
+		return
+	}
+	if request.APIVersion != APIVersion || request.Kind != KindLabelRequest {
+		writeResponse(w, http.StatusBadRequest, nil, fmt.Errorf("unsupported request %s %s, expected %s %s",
+			request.APIVersion, request.Kind, APIVersion, KindLabelRequest))
+		return
+	}
+	if request.PersistentVolume == nil {
+		writeResponse(w, http.StatusBadRequest, nil, fmt.Errorf("persistentVolume is required"))
+		return
+	}
+
+	ctx := r.Context()
+	if request.Timeout.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, request.Timeout.Duration)
+		defer cancel()
+	}
+	if request.DryRun {
+		ctx = labeler.WithDryRun(ctx)
+	}
+
+	labels, err := h.pvLabeler.GetLabelsForVolume(ctx, request.PersistentVolume)
+	if err != nil {
+		klog.ErrorS(err, "Failed to look up volume labels", "pv", klog.KObj(request.PersistentVolume))
+		writeResponse(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+	writeResponse(w, http.StatusOK, labels, nil)
+}
+
+func writeResponse(w http.ResponseWriter, status int, labels map[string]string, err error) {
+	response := &LabelResponse{
+		TypeMeta: metav1.TypeMeta{APIVersion: APIVersion, Kind: KindLabelResponse},
+		Labels:   labels,
+	}
+	if err != nil {
+		response.Error = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		klog.ErrorS(err, "Failed to write external labeler response")
+	}
+}
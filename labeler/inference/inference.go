@@ -0,0 +1,222 @@
+// Package inference implements a cloudprovider.PVLabeler inferring the labels
+// of volumes without querying a cloud API, from volume identifiers encoding
+// their location or from the allowed topologies of their StorageClass.
+package inference
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/csi-translation-lib/plugins"
+
+	"sigs.k8s.io/cloud-pv-admission-labeler/labeler"
+)
+
+// The rules labels are inferred with, reported as their label source.
+const (
+	// RuleGCEDiskPath infers the zone or region from GCE PD paths such as
+	// projects/<project>/zones/<zone>/disks/<disk>.
+	RuleGCEDiskPath = "gce-disk-path"
+	// RuleAWSVolumeID infers the zone from EBS volume IDs such as
+	// aws://<zone>/<volume>.
+	RuleAWSVolumeID = "aws-volume-id"
+	// RuleAzureResourceGroup infers the region from the AKS node resource
+	// group of Azure disk URIs, named MC_<group>_<cluster>_<region>.
+	RuleAzureResourceGroup = "azure-resource-group"
+	// RuleStorageClass infers the zone and region from the allowedTopologies
+	// of the PV's StorageClass when they allow a single value.
+	RuleStorageClass = "storage-class"
+)
+
+var (
+	gceZonePattern            = regexp.MustCompile(`(?:^|/)zones/([^/]+)/`)
+	gceRegionPattern          = regexp.MustCompile(`(?:^|/)regions/([^/]+)/`)
+	awsVolumeIDPattern        = regexp.MustCompile(`^aws://([^/]+)/`)
+	awsZonePattern            = regexp.MustCompile(`^([a-z]{2}(?:-[a-z]+)+-\d+)[a-z]$`)
+	azureResourceGroupPattern = regexp.MustCompile(`(?i)/resourceGroups/MC_[^/]+_[^/]+_([a-z0-9]+)/`)
+)
+
+// zoneKeys and regionKeys are the topology keys of StorageClass allowed
+// topologies naming a zone or region.
+var (
+	zoneKeys = map[string]bool{
+		corev1.LabelTopologyZone:          true,
+		corev1.LabelFailureDomainBetaZone: true,
+		plugins.GCEPDTopologyKey:          true,
+		plugins.AWSEBSTopologyKey:         true,
+		plugins.AzureDiskTopologyKey:      true,
+		"topology.csi.vmware.com/zone":    true,
+	}
+	regionKeys = map[string]bool{
+		corev1.LabelTopologyRegion:          true,
+		corev1.LabelFailureDomainBetaRegion: true,
+		"topology.csi.vmware.com/region":    true,
+	}
+)
+
+// identifierRules are tried in order before the StorageClass.
+var identifierRules = []struct {
+	name  string
+	infer func(pv *corev1.PersistentVolume) map[string]string
+}{
+	{name: RuleGCEDiskPath, infer: gceDiskPathLabels},
+	{name: RuleAWSVolumeID, infer: awsVolumeIDLabels},
+	{name: RuleAzureResourceGroup, infer: azureResourceGroupLabels},
+}
+
+// Labeler is a cloudprovider.PVLabeler inferring the labels of volumes. The
+// identifiers of volumes take precedence over their StorageClass, volumes
+// matching no rule get no labels.
+type Labeler struct {
+	storageClasses storagelisters.StorageClassLister
+}
+
+var (
+	_ cloudprovider.PVLabeler = &Labeler{}
+	_ labeler.SourceLabeler   = &Labeler{}
+)
+
+// New returns a Labeler reading StorageClasses from the lister, usually backed
+// by an informer.
+func New(storageClasses storagelisters.StorageClassLister) *Labeler {
+	return &Labeler{storageClasses: storageClasses}
+}
+
+// GetLabelsForVolume returns the labels inferred for the PV's volume.
+func (l *Labeler) GetLabelsForVolume(ctx context.Context, pv *corev1.PersistentVolume) (map[string]string, error) {
+	labels, _, err := l.GetLabelsAndSourceForVolume(ctx, pv)
+	return labels, err
+}
+
+// GetLabelsAndSourceForVolume returns the labels inferred for the PV's volume
+// and the rule they were inferred with.
+func (l *Labeler) GetLabelsAndSourceForVolume(ctx context.Context, pv *corev1.PersistentVolume) (map[string]string, string, error) {
+	for _, rule := range identifierRules {
+		if labels := rule.infer(pv); len(labels) > 0 {
+			return labels, rule.name, nil
+		}
+	}
+
+	labels, err := l.storageClassLabels(pv)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(labels) > 0 {
+		return labels, RuleStorageClass, nil
+	}
+	return nil, "", nil
+}
+
+// storageClassLabels returns the zone and region the allowedTopologies of the
+// PV's StorageClass restrict it to, if any.
+func (l *Labeler) storageClassLabels(pv *corev1.PersistentVolume) (map[string]string, error) {
+	if pv.Spec.StorageClassName == "" {
+		return nil, nil
+	}
+	class, err := l.storageClasses.Get(pv.Spec.StorageClassName)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting StorageClass %s: %v", pv.Spec.StorageClassName, err)
+	}
+
+	labels := make(map[string]string)
+	if zone, ok := topologyValue(class.AllowedTopologies, zoneKeys); ok {
+		labels[corev1.LabelTopologyZone] = zone
+	}
+	if region, ok := topologyValue(class.AllowedTopologies, regionKeys); ok {
+		labels[corev1.LabelTopologyRegion] = region
+	}
+	return labels, nil
+}
+
+// topologyValue returns the single value of the keys allowed by the terms.
+// Terms are ORed, so every term must restrict the keys to the same value.
+func topologyValue(terms []corev1.TopologySelectorTerm, keys map[string]bool) (string, bool) {
+	var value string
+	for _, term := range terms {
+		var termValue string
+		for _, requirement := range term.MatchLabelExpressions {
+			if !keys[requirement.Key] {
+				continue
+			}
+			if len(requirement.Values) != 1 || (termValue != "" && termValue != requirement.Values[0]) {
+				return "", false
+			}
+			termValue = requirement.Values[0]
+		}
+		if termValue == "" || (value != "" && value != termValue) {
+			return "", false
+		}
+		value = termValue
+	}
+	return value, value != ""
+}
+
+func gceDiskPathLabels(pv *corev1.PersistentVolume) map[string]string {
+	var path string
+	switch {
+	case pv.Spec.GCEPersistentDisk != nil:
+		path = pv.Spec.GCEPersistentDisk.PDName
+	case pv.Spec.CSI != nil && pv.Spec.CSI.Driver == plugins.GCEPDDriverName:
+		path = pv.Spec.CSI.VolumeHandle
+	default:
+		return nil
+	}
+
+	if match := gceZonePattern.FindStringSubmatch(path); match != nil {
+		labels := map[string]string{corev1.LabelTopologyZone: match[1]}
+		// GCE zones are named <region>-<letter>
+		if i := strings.LastIndex(match[1], "-"); i > 0 {
+			labels[corev1.LabelTopologyRegion] = match[1][:i]
+		}
+		return labels
+	}
+	if match := gceRegionPattern.FindStringSubmatch(path); match != nil {
+		return map[string]string{corev1.LabelTopologyRegion: match[1]}
+	}
+	return nil
+}
+
+func awsVolumeIDLabels(pv *corev1.PersistentVolume) map[string]string {
+	if pv.Spec.AWSElasticBlockStore == nil {
+		return nil
+	}
+	match := awsVolumeIDPattern.FindStringSubmatch(pv.Spec.AWSElasticBlockStore.VolumeID)
+	if match == nil {
+		return nil
+	}
+
+	labels := map[string]string{corev1.LabelTopologyZone: match[1]}
+	// Only regular availability zones are named <region><letter>, not local
+	// and wavelength zones
+	if zone := awsZonePattern.FindStringSubmatch(match[1]); zone != nil {
+		labels[corev1.LabelTopologyRegion] = zone[1]
+	}
+	return labels
+}
+
+func azureResourceGroupLabels(pv *corev1.PersistentVolume) map[string]string {
+	var diskURI string
+	switch {
+	case pv.Spec.AzureDisk != nil:
+		diskURI = pv.Spec.AzureDisk.DataDiskURI
+	case pv.Spec.CSI != nil && pv.Spec.CSI.Driver == plugins.AzureDiskDriverName:
+		diskURI = pv.Spec.CSI.VolumeHandle
+	default:
+		return nil
+	}
+
+	match := azureResourceGroupPattern.FindStringSubmatch(diskURI)
+	if match == nil {
+		return nil
+	}
+	return map[string]string{corev1.LabelTopologyRegion: strings.ToLower(match[1])}
+}
@@ -0,0 +1,192 @@
+package inference
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newStorageClass(name string, terms ...corev1.TopologySelectorTerm) *storagev1.StorageClass {
+	return &storagev1.StorageClass{
+		ObjectMeta:        metav1.ObjectMeta{Name: name},
+		AllowedTopologies: terms,
+	}
+}
+
+func newTerm(requirements map[string][]string) corev1.TopologySelectorTerm {
+	term := corev1.TopologySelectorTerm{}
+	for key, values := range requirements {
+		term.MatchLabelExpressions = append(term.MatchLabelExpressions, corev1.TopologySelectorLabelRequirement{Key: key, Values: values})
+	}
+	return term
+}
+
+func Test_Labeler(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, class := range []*storagev1.StorageClass{
+		newStorageClass("zonal", newTerm(map[string][]string{
+			corev1.LabelTopologyZone:   {"us-central1-a"},
+			corev1.LabelTopologyRegion: {"us-central1"},
+		})),
+		newStorageClass("csi-zonal", newTerm(map[string][]string{"topology.gke.io/zone": {"us-central1-b"}})),
+		newStorageClass("same-zone-terms",
+			newTerm(map[string][]string{corev1.LabelTopologyZone: {"us-central1-c"}}),
+			newTerm(map[string][]string{corev1.LabelTopologyZone: {"us-central1-c"}, "example.com/rack": {"r1"}}),
+		),
+		newStorageClass("multi-zone", newTerm(map[string][]string{corev1.LabelTopologyZone: {"us-central1-a", "us-central1-b"}})),
+		newStorageClass("zone-terms",
+			newTerm(map[string][]string{corev1.LabelTopologyZone: {"us-central1-a"}}),
+			newTerm(map[string][]string{corev1.LabelTopologyZone: {"us-central1-b"}}),
+		),
+		newStorageClass("unrestricted-term",
+			newTerm(map[string][]string{corev1.LabelTopologyZone: {"us-central1-a"}}),
+			newTerm(map[string][]string{"example.com/rack": {"r1"}}),
+		),
+		newStorageClass("unrestricted"),
+	} {
+		if err := indexer.Add(class); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	labeler := New(storagelisters.NewStorageClassLister(indexer))
+
+	testcases := []struct {
+		name           string
+		source         corev1.PersistentVolumeSource
+		storageClass   string
+		expectedLabels map[string]string
+		expectedRule   string
+	}{
+		{
+			name: "GCE PD CSI zonal handle",
+			source: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: "pd.csi.storage.gke.io", VolumeHandle: "projects/p/zones/europe-west1-b/disks/disk-1"},
+			},
+			storageClass: "zonal",
+			expectedLabels: map[string]string{
+				corev1.LabelTopologyZone:   "europe-west1-b",
+				corev1.LabelTopologyRegion: "europe-west1",
+			},
+			expectedRule: RuleGCEDiskPath,
+		},
+		{
+			name: "GCE PD CSI regional handle",
+			source: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: "pd.csi.storage.gke.io", VolumeHandle: "projects/p/regions/europe-west1/disks/disk-1"},
+			},
+			expectedLabels: map[string]string{corev1.LabelTopologyRegion: "europe-west1"},
+			expectedRule:   RuleGCEDiskPath,
+		},
+		{
+			name: "GCE PD name",
+			source: corev1.PersistentVolumeSource{
+				GCEPersistentDisk: &corev1.GCEPersistentDiskVolumeSource{PDName: "disk-1"},
+			},
+			storageClass: "zonal",
+			expectedLabels: map[string]string{
+				corev1.LabelTopologyZone:   "us-central1-a",
+				corev1.LabelTopologyRegion: "us-central1",
+			},
+			expectedRule: RuleStorageClass,
+		},
+		{
+			name: "AWS EBS volume ID with zone",
+			source: corev1.PersistentVolumeSource{
+				AWSElasticBlockStore: &corev1.AWSElasticBlockStoreVolumeSource{VolumeID: "aws://us-east-1a/vol-123"},
+			},
+			expectedLabels: map[string]string{
+				corev1.LabelTopologyZone:   "us-east-1a",
+				corev1.LabelTopologyRegion: "us-east-1",
+			},
+			expectedRule: RuleAWSVolumeID,
+		},
+		{
+			name: "AWS EBS volume ID with local zone",
+			source: corev1.PersistentVolumeSource{
+				AWSElasticBlockStore: &corev1.AWSElasticBlockStoreVolumeSource{VolumeID: "aws://us-west-2-lax-1a/vol-123"},
+			},
+			expectedLabels: map[string]string{corev1.LabelTopologyZone: "us-west-2-lax-1a"},
+			expectedRule:   RuleAWSVolumeID,
+		},
+		{
+			name: "AWS EBS volume ID without zone",
+			source: corev1.PersistentVolumeSource{
+				AWSElasticBlockStore: &corev1.AWSElasticBlockStoreVolumeSource{VolumeID: "vol-123"},
+			},
+		},
+		{
+			name: "Azure disk in AKS node resource group",
+			source: corev1.PersistentVolumeSource{
+				AzureDisk: &corev1.AzureDiskVolumeSource{DataDiskURI: "/subscriptions/s/resourceGroups/MC_rg_cluster_WestEurope/providers/Microsoft.Compute/disks/disk-1"},
+			},
+			expectedLabels: map[string]string{corev1.LabelTopologyRegion: "westeurope"},
+			expectedRule:   RuleAzureResourceGroup,
+		},
+		{
+			name: "Azure disk in other resource group",
+			source: corev1.PersistentVolumeSource{
+				AzureDisk: &corev1.AzureDiskVolumeSource{DataDiskURI: "/subscriptions/s/resourceGroups/disks/providers/Microsoft.Compute/disks/disk-1"},
+			},
+		},
+		{
+			name:           "StorageClass with CSI topology key",
+			source:         corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{Driver: "pd.csi.storage.gke.io", VolumeHandle: "disk-1"}},
+			storageClass:   "csi-zonal",
+			expectedLabels: map[string]string{corev1.LabelTopologyZone: "us-central1-b"},
+			expectedRule:   RuleStorageClass,
+		},
+		{
+			name:           "StorageClass with terms of the same zone",
+			storageClass:   "same-zone-terms",
+			expectedLabels: map[string]string{corev1.LabelTopologyZone: "us-central1-c"},
+			expectedRule:   RuleStorageClass,
+		},
+		{
+			name:         "StorageClass with several zones",
+			storageClass: "multi-zone",
+		},
+		{
+			name:         "StorageClass with terms of several zones",
+			storageClass: "zone-terms",
+		},
+		{
+			name:         "StorageClass with a term not restricting the zone",
+			storageClass: "unrestricted-term",
+		},
+		{
+			name:         "StorageClass without allowed topologies",
+			storageClass: "unrestricted",
+		},
+		{
+			name:         "missing StorageClass",
+			storageClass: "missing",
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			pv := &corev1.PersistentVolume{Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeSource: testcase.source,
+				StorageClassName:       testcase.storageClass,
+			}}
+			labels, rule, err := labeler.GetLabelsAndSourceForVolume(context.Background(), pv)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(labels, testcase.expectedLabels) {
+				t.Logf("actual labels: %v", labels)
+				t.Logf("expected labels: %v", testcase.expectedLabels)
+				t.Error("unexpected labels")
+			}
+			if rule != testcase.expectedRule {
+				t.Errorf("expected rule %q, got %q", testcase.expectedRule, rule)
+			}
+		})
+	}
+}
@@ -0,0 +1,20 @@
+// Package labeler contains the cloudprovider.PVLabeler implementations wrapped
+// around the cloud providers and the helpers they share.
+package labeler
+
+import "context"
+
+type dryRunKey struct{}
+
+// WithDryRun returns a context marking the lookups made with it as part of a
+// dry-run request. They must return the same labels but have no side effects,
+// e.g. populating a cache or recording Events.
+func WithDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, true)
+}
+
+// IsDryRun returns true if the context belongs to a dry-run request.
+func IsDryRun(ctx context.Context) bool {
+	dryRun, _ := ctx.Value(dryRunKey{}).(bool)
+	return dryRun
+}
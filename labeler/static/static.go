@@ -0,0 +1,255 @@
+// Package static implements a cloudprovider.PVLabeler resolving the labels of
+// volumes from a local mapping file, for clusters that cannot reach any cloud
+// API.
+package static
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// Mapping maps volumes to their zone and region. Volumes are identified by
+// their PD name, EBS volume ID, Azure disk URI or vSphere volume path, either
+// exactly or with a regular expression.
+type Mapping struct {
+	// Volume is the exact identifier of the volume.
+	Volume string `json:"volume,omitempty"`
+	// Pattern is a regular expression matching the identifiers of volumes.
+	Pattern string `json:"pattern,omitempty"`
+	Zone    string `json:"zone"`
+	Region  string `json:"region,omitempty"`
+}
+
+// File is the format of YAML and JSON mapping files. CSV files have a header
+// row naming the volume, pattern, zone and region columns instead.
+type File struct {
+	Volumes []Mapping `json:"volumes"`
+}
+
+type pattern struct {
+	re     *regexp.Regexp
+	labels map[string]string
+}
+
+// mappings are the parsed mappings of a file.
+type mappings struct {
+	volumes  map[string]map[string]string
+	patterns []pattern
+}
+
+// Labeler is a cloudprovider.PVLabeler returning the labels mapped to volumes
+// in a file. Exact volume mappings take precedence over patterns, which are
+// matched in the order of the file.
+type Labeler struct {
+	path     string
+	interval time.Duration
+
+	mu       sync.RWMutex
+	data     []byte
+	mappings *mappings
+}
+
+var _ cloudprovider.PVLabeler = &Labeler{}
+
+// New returns a Labeler reading the mapping file at path, which is parsed as
+// CSV if its extension is .csv and as YAML otherwise. The file is loaded
+// immediately and an error is returned if it is not valid.
+func New(path string, interval time.Duration) (*Labeler, error) {
+	l := &Labeler{
+		path:     path,
+		interval: interval,
+	}
+
+	if err := l.reload(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Start polls the mapping file until the context is done. If a reload fails
+// the last good mappings keep being used.
+func (l *Labeler) Start(ctx context.Context) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := l.reload(); err != nil {
+			klog.ErrorS(err, "failed to reload volume mappings, keeping the current ones", "path", l.path)
+		}
+	}, l.interval)
+}
+
+// GetLabelsForVolume returns the zone and region labels mapped to the PV's
+// volume. It returns an error if no mapping matches the volume.
+func (l *Labeler) GetLabelsForVolume(ctx context.Context, pv *corev1.PersistentVolume) (map[string]string, error) {
+	volume, ok := volumeIdentifier(pv)
+	if !ok {
+		return nil, nil
+	}
+
+	l.mu.RLock()
+	m := l.mappings
+	l.mu.RUnlock()
+
+	if labels, ok := m.volumes[volume]; ok {
+		return copyLabels(labels), nil
+	}
+	for _, p := range m.patterns {
+		if p.re.MatchString(volume) {
+			return copyLabels(p.labels), nil
+		}
+	}
+	return nil, fmt.Errorf("no zone mapped to volume %s in %s", volume, l.path)
+}
+
+func (l *Labeler) reload() error {
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return fmt.Errorf("error reading volume mapping file %s: %v", l.path, err)
+	}
+
+	l.mu.RLock()
+	unchanged := l.mappings != nil && bytes.Equal(data, l.data)
+	l.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	var file *File
+	if strings.EqualFold(filepath.Ext(l.path), ".csv") {
+		file, err = parseCSV(bytes.NewReader(data))
+	} else {
+		file = &File{}
+		err = yaml.UnmarshalStrict(data, file)
+	}
+	if err != nil {
+		return fmt.Errorf("error parsing volume mapping file %s: %v", l.path, err)
+	}
+
+	m, err := compile(file)
+	if err != nil {
+		return fmt.Errorf("invalid volume mapping file %s: %v", l.path, err)
+	}
+
+	l.mu.Lock()
+	l.data = data
+	l.mappings = m
+	l.mu.Unlock()
+
+	klog.InfoS("Loaded volume mappings", "path", l.path, "volumes", len(m.volumes), "patterns", len(m.patterns))
+	return nil
+}
+
+// parseCSV parses a CSV mapping file.
+func parseCSV(r io.Reader) (*File, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading header: %v", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, column := range header {
+		switch column = strings.ToLower(strings.TrimSpace(column)); column {
+		case "volume", "pattern", "zone", "region":
+			columns[column] = i
+		default:
+			return nil, fmt.Errorf("unknown column %q, must be volume, pattern, zone or region", column)
+		}
+	}
+	field := func(record []string, column string) string {
+		if i, ok := columns[column]; ok {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	file := &File{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return file, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		file.Volumes = append(file.Volumes, Mapping{
+			Volume:  field(record, "volume"),
+			Pattern: field(record, "pattern"),
+			Zone:    field(record, "zone"),
+			Region:  field(record, "region"),
+		})
+	}
+}
+
+// compile validates the mappings and compiles their patterns.
+func compile(file *File) (*mappings, error) {
+	m := &mappings{volumes: make(map[string]map[string]string)}
+	for i, mapping := range file.Volumes {
+		if (mapping.Volume == "") == (mapping.Pattern == "") {
+			return nil, fmt.Errorf("mapping %d: exactly one of volume and pattern must be set", i)
+		}
+		if mapping.Zone == "" {
+			return nil, fmt.Errorf("mapping %d: zone is required", i)
+		}
+
+		labels := map[string]string{corev1.LabelTopologyZone: mapping.Zone}
+		if mapping.Region != "" {
+			labels[corev1.LabelTopologyRegion] = mapping.Region
+		}
+
+		if mapping.Volume != "" {
+			if _, ok := m.volumes[mapping.Volume]; ok {
+				return nil, fmt.Errorf("mapping %d: volume %s is mapped more than once", i, mapping.Volume)
+			}
+			m.volumes[mapping.Volume] = labels
+			continue
+		}
+
+		re, err := regexp.Compile(mapping.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("mapping %d: invalid pattern: %v", i, err)
+		}
+		m.patterns = append(m.patterns, pattern{re: re, labels: labels})
+	}
+	return m, nil
+}
+
+// volumeIdentifier returns the identifier of the PV's in-tree volume, or false
+// if its volume source cannot be mapped.
+func volumeIdentifier(pv *corev1.PersistentVolume) (string, bool) {
+	switch {
+	case pv.Spec.GCEPersistentDisk != nil:
+		return pv.Spec.GCEPersistentDisk.PDName, true
+	case pv.Spec.AWSElasticBlockStore != nil:
+		return pv.Spec.AWSElasticBlockStore.VolumeID, true
+	case pv.Spec.AzureDisk != nil:
+		return pv.Spec.AzureDisk.DataDiskURI, true
+	case pv.Spec.VsphereVolume != nil:
+		return pv.Spec.VsphereVolume.VolumePath, true
+	}
+	return "", false
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	copied := make(map[string]string, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+	}
+	return copied
+}
@@ -0,0 +1,165 @@
+package static
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const testYAML = `
+volumes:
+- volume: vol-123
+  zone: us-east-1a
+  region: us-east-1
+- pattern: '^\[datastore-a\] '
+  zone: zone-a
+- pattern: '^vol-'
+  zone: us-east-1b
+  region: us-east-1
+`
+
+const testCSV = `volume,pattern,zone,region
+# exact mappings take precedence over patterns
+vol-123,,us-east-1a,us-east-1
+,^\[datastore-a\] ,zone-a,
+,^vol-,us-east-1b,us-east-1
+`
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+	return path
+}
+
+func Test_Labeler(t *testing.T) {
+	ebsPV := func(volumeID string) *corev1.PersistentVolume {
+		return &corev1.PersistentVolume{Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: corev1.PersistentVolumeSource{
+			AWSElasticBlockStore: &corev1.AWSElasticBlockStoreVolumeSource{VolumeID: volumeID},
+		}}}
+	}
+	vspherePV := func(volumePath string) *corev1.PersistentVolume {
+		return &corev1.PersistentVolume{Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: corev1.PersistentVolumeSource{
+			VsphereVolume: &corev1.VsphereVirtualDiskVolumeSource{VolumePath: volumePath},
+		}}}
+	}
+
+	testcases := []struct {
+		name           string
+		pv             *corev1.PersistentVolume
+		expectedLabels map[string]string
+		expectErr      bool
+	}{
+		{
+			name: "exact volume",
+			pv:   ebsPV("vol-123"),
+			expectedLabels: map[string]string{
+				corev1.LabelTopologyZone:   "us-east-1a",
+				corev1.LabelTopologyRegion: "us-east-1",
+			},
+		},
+		{
+			name: "volume pattern",
+			pv:   ebsPV("vol-456"),
+			expectedLabels: map[string]string{
+				corev1.LabelTopologyZone:   "us-east-1b",
+				corev1.LabelTopologyRegion: "us-east-1",
+			},
+		},
+		{
+			name:           "volume pattern without region",
+			pv:             vspherePV("[datastore-a] volumes/pv.vmdk"),
+			expectedLabels: map[string]string{corev1.LabelTopologyZone: "zone-a"},
+		},
+		{
+			name:      "unmapped volume",
+			pv:        vspherePV("[datastore-b] volumes/pv.vmdk"),
+			expectErr: true,
+		},
+		{
+			name: "unsupported volume",
+			pv:   &corev1.PersistentVolume{},
+		},
+	}
+
+	for _, format := range []struct{ name, content string }{{"mappings.yaml", testYAML}, {"mappings.csv", testCSV}} {
+		labeler, err := New(writeFile(t, format.name, format.content), 0)
+		if err != nil {
+			t.Fatalf("unexpected error loading %s: %v", format.name, err)
+		}
+
+		for _, testcase := range testcases {
+			t.Run(format.name+"/"+testcase.name, func(t *testing.T) {
+				labels, err := labeler.GetLabelsForVolume(context.Background(), testcase.pv)
+				if (err != nil) != testcase.expectErr {
+					t.Fatalf("expected error %v, got %v", testcase.expectErr, err)
+				}
+				if !reflect.DeepEqual(labels, testcase.expectedLabels) {
+					t.Logf("actual labels: %v", labels)
+					t.Logf("expected labels: %v", testcase.expectedLabels)
+					t.Error("unexpected labels")
+				}
+			})
+		}
+	}
+}
+
+func Test_LabelerReload(t *testing.T) {
+	path := writeFile(t, "mappings.yaml", testYAML)
+	labeler, err := New(path, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pv := &corev1.PersistentVolume{Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: corev1.PersistentVolumeSource{
+		GCEPersistentDisk: &corev1.GCEPersistentDiskVolumeSource{PDName: "disk-1"},
+	}}}
+	if _, err := labeler.GetLabelsForVolume(context.Background(), pv); err == nil {
+		t.Fatal("expected error for unmapped volume")
+	}
+
+	// Invalid files are ignored
+	if err := os.WriteFile(path, []byte("volumes:\n- volume: disk-1\n"), 0o644); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+	if err := labeler.reload(); err == nil {
+		t.Fatal("expected error for mapping without zone")
+	}
+
+	if err := os.WriteFile(path, []byte("volumes:\n- volume: disk-1\n  zone: europe-west1-b\n"), 0o644); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+	if err := labeler.reload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	labels, err := labeler.GetLabelsForVolume(context.Background(), pv)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := map[string]string{corev1.LabelTopologyZone: "europe-west1-b"}; !reflect.DeepEqual(labels, expected) {
+		t.Errorf("expected labels %v, got %v", expected, labels)
+	}
+}
+
+func Test_compile(t *testing.T) {
+	testcases := []struct {
+		name    string
+		mapping Mapping
+	}{
+		{name: "volume and pattern", mapping: Mapping{Volume: "vol-1", Pattern: "^vol-", Zone: "zone-a"}},
+		{name: "neither volume nor pattern", mapping: Mapping{Zone: "zone-a"}},
+		{name: "invalid pattern", mapping: Mapping{Pattern: "(", Zone: "zone-a"}},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			if _, err := compile(&File{Volumes: []Mapping{testcase.mapping}}); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"flag"
@@ -10,10 +11,19 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
 	kscheme "k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 	cloudprovider "k8s.io/cloud-provider"
 	"k8s.io/klog/v2"
 
@@ -23,22 +33,113 @@ import (
 	_ "k8s.io/legacy-cloud-providers/vsphere"
 
 	"sigs.k8s.io/cloud-pv-admission-labeler/admission"
+	"sigs.k8s.io/cloud-pv-admission-labeler/auditlog"
+	"sigs.k8s.io/cloud-pv-admission-labeler/certs"
+	"sigs.k8s.io/cloud-pv-admission-labeler/health"
+	"sigs.k8s.io/cloud-pv-admission-labeler/metrics"
 )
 
+// serverShutdownTimeout bounds how long in-flight admission requests are
+// waited for on SIGTERM.
+const serverShutdownTimeout = 10 * time.Second
+
 var (
 	addr            string
 	tlsCertPath     string
 	tlsKeyPath      string
+	tlsReloadPeriod time.Duration
 	cloudProvider   string
 	cloudConfigPath string
+	kubeconfig      string
+
+	cloudRequestTimeout  time.Duration
+	cloudFailurePolicy   string
+	nodeAffinityStrategy string
+	labelPolicy          string
+	stripBetaLabels      bool
+	cacheTTL             time.Duration
+	cacheNegativeTTL     time.Duration
+
+	externalLabelerEndpoint string
+	externalLabelerTimeout  time.Duration
+	externalLabelerCAFile   string
+	staticReloadPeriod      time.Duration
+
+	labelSourceList    string
+	labelSourceTimeout time.Duration
+
+	auditLogPath       string
+	auditLogMaxSize    int
+	auditLogMaxBackups int
+	auditLogMaxAge     int
+	auditLogCompress   bool
+
+	tracingEndpoint      string
+	tracingInsecure      bool
+	tracingSamplingRatio float64
+	tracingServiceName   string
+
+	recordEvents bool
+
+	selfSignedCerts        bool
+	selfSignedCertValidity time.Duration
+	namespace              string
+	serviceName            string
+	certSecretName         string
+	webhookName            string
+	validatingWebhookName  string
+
+	healthCheckVolume string
+	healthCheckPeriod time.Duration
 )
 
+// certificateSource provides the webhook's serving certificate.
+type certificateSource interface {
+	GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	NotAfter() time.Time
+	Start(ctx context.Context)
+}
+
 func main() {
 	flag.StringVar(&addr, "addr", ":9001", "listen address of the server")
 	flag.StringVar(&tlsCertPath, "tls-cert-path", "", "the path to the serving certificate")
 	flag.StringVar(&tlsKeyPath, "tls-key-path", "", "the path to the serving key")
-	flag.StringVar(&cloudProvider, "cloud-provider", "", "the cloud provider implementation")
-	flag.StringVar(&cloudConfigPath, "cloud-config", "", "the path to the cloud config")
+	flag.DurationVar(&tlsReloadPeriod, "tls-reload-period", 10*time.Second, "how often the serving certificate and key are checked for changes")
+	flag.StringVar(&cloudProvider, "cloud-provider", "", "the cloud provider implementation, or a comma-separated list of them each labeling the PVs of its own volume sources; \"static\" labels the PVs of the cloud providers that are not configured from the mapping file set in --cloud-config, \"inference\" labels them from their volume identifiers and StorageClasses, \"external\" labels the PVs of all other volume sources with an external labeler")
+	flag.StringVar(&cloudConfigPath, "cloud-config", "", "the path to the cloud config, or a comma-separated list of provider=path pairs with several cloud providers")
+	flag.DurationVar(&cloudRequestTimeout, "cloud-request-timeout", 4*time.Second, "the maximum time spent looking up a volume from the cloud provider, should be below the webhook's timeoutSeconds")
+	flag.StringVar(&cloudFailurePolicy, "cloud-failure-policy", string(admission.FailurePolicyFail), "how PVs are handled when their labels cannot be retrieved from the cloud provider: \"fail\" denies them, \"open\" admits them without labels and annotates them as pending")
+	flag.StringVar(&nodeAffinityStrategy, "node-affinity-strategy", string(admission.NodeAffinityStrategySkip), "how node affinity generated from the cloud labels is merged with the PV's node affinity on the same keys: \"skip\" adds none of it, \"replace\" replaces the PV's expressions, \"intersect\" keeps the values allowed by both and denies the PV if there are none, \"add-nonconflicting\" adds only the requirements on other keys")
+	flag.StringVar(&labelPolicy, "label-policy", string(admission.LabelPolicyAsIs), "which topology labels are set: \"as-is\" as returned by the cloud provider, \"ga\" only topology.kubernetes.io labels, \"beta\" only failure-domain.beta.kubernetes.io labels or \"both\"")
+	flag.BoolVar(&stripBetaLabels, "strip-beta-labels", false, "remove the deprecated failure-domain.beta.kubernetes.io labels from PVs, requires --label-policy=ga")
+	flag.DurationVar(&cacheTTL, "cache-ttl", 0, "how long volume labels returned by the cloud provider are cached, caching is disabled if zero")
+	flag.DurationVar(&cacheNegativeTTL, "cache-negative-ttl", 10*time.Second, "how long failed cloud provider lookups are cached when caching is enabled, negative caching is disabled if zero")
+	flag.StringVar(&externalLabelerEndpoint, "external-labeler-endpoint", "", "the http, https or unix:// URL of the external labeler, required with --cloud-provider=external")
+	flag.DurationVar(&externalLabelerTimeout, "external-labeler-timeout", 5*time.Second, "the maximum time spent on a request to the external labeler")
+	flag.StringVar(&externalLabelerCAFile, "external-labeler-ca-file", "", "the path to the CA bundle verifying an https external labeler, the system roots are used if empty")
+	flag.DurationVar(&staticReloadPeriod, "static-reload-period", 10*time.Second, "how often the mapping file of the static cloud provider is checked for changes")
+	flag.StringVar(&labelSourceList, "label-sources", labelSourceCloud, "the comma-separated label sources of the cloud providers' volumes, asked in order until one of them returns labels: \"cloud\" queries the cloud provider, \"snapshot\" returns the labels last returned by the cloud provider and requires --cache-ttl, \"static\" resolves them from the mapping file of the static cloud provider, \"inference\" infers them from volume identifiers and StorageClasses")
+	flag.DurationVar(&labelSourceTimeout, "label-source-timeout", 2*time.Second, "the maximum time spent on each label source before falling back to the next one, unlimited if zero")
+	flag.StringVar(&auditLogPath, "audit-log-path", "", "the path of the file every admission decision is recorded in as a JSON line, \"-\" for stdout, disabled if empty")
+	flag.IntVar(&auditLogMaxSize, "audit-log-max-size", 100, "the size in megabytes at which the audit log file is rotated")
+	flag.IntVar(&auditLogMaxBackups, "audit-log-max-backups", 10, "the number of rotated audit log files kept, all if zero")
+	flag.IntVar(&auditLogMaxAge, "audit-log-max-age", 0, "the number of days rotated audit log files are kept, forever if zero")
+	flag.BoolVar(&auditLogCompress, "audit-log-compress", false, "gzip the rotated audit log files")
+	flag.StringVar(&tracingEndpoint, "tracing-endpoint", "", "the host:port of the OTLP gRPC collector admission request traces are exported to, tracing is disabled if empty; the OTEL_EXPORTER_OTLP_* environment variables configure the exporter further")
+	flag.BoolVar(&tracingInsecure, "tracing-insecure", false, "export traces to the --tracing-endpoint without TLS")
+	flag.Float64Var(&tracingSamplingRatio, "tracing-sampling-ratio", 0, "the fraction of admission requests traced unless the API server's trace context decides, none if zero")
+	flag.StringVar(&tracingServiceName, "tracing-service-name", "cloud-pv-admission-labeler", "the service name traces are exported with")
+	flag.BoolVar(&recordEvents, "record-events", false, "record Kubernetes Events on PVs for labeling failures, node affinity conflicts, denials and fallbacks to trusted or pending labels")
+	flag.StringVar(&kubeconfig, "kubeconfig", "", "the path to a kubeconfig, only required if running out-of-cluster")
+	flag.BoolVar(&selfSignedCerts, "self-signed-certs", false, "generate a CA and serving certificate, store them in a Secret and inject the CA into the webhook configuration instead of using --tls-cert-path and --tls-key-path")
+	flag.DurationVar(&selfSignedCertValidity, "self-signed-cert-validity", 365*24*time.Hour, "how long generated serving certificates are valid, the CA is valid ten times as long")
+	flag.StringVar(&namespace, "namespace", "kube-system", "the namespace the webhook runs in")
+	flag.StringVar(&serviceName, "service-name", "cloud-pv-admission-labeler", "the name of the webhook Service")
+	flag.StringVar(&certSecretName, "cert-secret-name", "cloud-pv-admission-labeler-certs", "the name of the Secret generated certificates are stored in")
+	flag.StringVar(&webhookName, "webhook-name", "cloud-pvl-admission.k8s.io", "the name of the MutatingWebhookConfiguration the generated CA is injected into")
+	flag.StringVar(&validatingWebhookName, "validating-webhook-name", "cloud-pvl-validation.k8s.io", "the name of the ValidatingWebhookConfiguration the generated CA is injected into if it exists")
+	flag.StringVar(&healthCheckVolume, "health-check-volume", "", "the ID of an existing volume (PD name, EBS volume ID, Azure disk URI or vSphere volume path) looked up periodically to check cloud provider health for readiness, or a comma-separated list of provider=volume pairs with several cloud providers, disabled if empty")
+	flag.DurationVar(&healthCheckPeriod, "health-check-period", time.Minute, "how often the --health-check-volume is looked up")
 	flag.Parse()
 
 	scheme := runtime.NewScheme()
@@ -50,25 +151,235 @@ func main() {
 		klog.Fatalf("error adding admission/v1 types to scheme: %v", err)
 	}
 
-	pvLabeler, err := newProvider(cloudProvider, cloudConfigPath)
+	switch admission.FailurePolicy(cloudFailurePolicy) {
+	case admission.FailurePolicyFail, admission.FailurePolicyOpen:
+	default:
+		klog.Fatalf("invalid --cloud-failure-policy %q, must be %q or %q", cloudFailurePolicy, admission.FailurePolicyFail, admission.FailurePolicyOpen)
+	}
+
+	if !isValidNodeAffinityStrategy(admission.NodeAffinityStrategy(nodeAffinityStrategy)) {
+		klog.Fatalf("invalid --node-affinity-strategy %q, must be one of %v", nodeAffinityStrategy, admission.NodeAffinityStrategies)
+	}
+
+	if !isValidLabelPolicy(admission.LabelPolicy(labelPolicy)) {
+		klog.Fatalf("invalid --label-policy %q, must be one of %v", labelPolicy, admission.LabelPolicies)
+	}
+	if stripBetaLabels && admission.LabelPolicy(labelPolicy) != admission.LabelPolicyGA {
+		klog.Fatalf("--strip-beta-labels requires --label-policy=%s", admission.LabelPolicyGA)
+	}
+
+	pvLabelers, uncachedLabelers, err := newPVLabelers(cloudProvider, cloudConfigPath)
 	if err != nil {
 		klog.Fatalf("error initializing cloud provider: %v", err)
 	}
+	labelSources, err := chainLabelSources(pvLabelers, splitList(labelSourceList))
+	if err != nil {
+		klog.Fatalf("error initializing label sources: %v", err)
+	}
 
-	pvLabelAdmission := admission.NewPVLabelAdmission(cloudProvider, scheme, pvLabeler)
+	var auditLog *auditlog.Logger
+	if auditLogPath != "" {
+		auditLog = auditlog.NewFile(auditLogPath, auditlog.FileConfig{
+			MaxSizeMB:  auditLogMaxSize,
+			MaxBackups: auditLogMaxBackups,
+			MaxAgeDays: auditLogMaxAge,
+			Compress:   auditLogCompress,
+		})
+	}
+
+	tracerProvider, shutdownTracerProvider, err := newTracerProvider(context.Background())
+	if err != nil {
+		klog.Fatalf("error initializing tracing: %v", err)
+	}
+	shutdownTracing := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		defer cancel()
+		if err := shutdownTracerProvider(ctx); err != nil {
+			klog.ErrorS(err, "failed to export remaining spans")
+		}
+	}
+	defer shutdownTracing()
+	// exit exports the spans of a command before exiting, since os.Exit does
+	// not run deferred functions.
+	exit := func(code int) {
+		shutdownTracing()
+		os.Exit(code)
+	}
+
+	var eventRecorder record.EventRecorder
+	if recordEvents {
+		eventRecorder, err = newEventRecorder(scheme)
+		if err != nil {
+			klog.Fatalf("error initializing event recorder: %v", err)
+		}
+	}
+
+	pvLabelAdmission := admission.NewMultiProviderPVLabelAdmission(scheme, pvLabelers, admission.Options{
+		FailurePolicy:        admission.FailurePolicy(cloudFailurePolicy),
+		CloudRequestTimeout:  cloudRequestTimeout,
+		NodeAffinityStrategy: admission.NodeAffinityStrategy(nodeAffinityStrategy),
+		LabelPolicy:          admission.LabelPolicy(labelPolicy),
+		StripBetaLabels:      stripBetaLabels,
+		LabelSources:         labelSources,
+		AuditLog:             auditLog,
+		TracerProvider:       tracerProvider,
+		EventRecorder:        eventRecorder,
+	})
+
+	switch command := flag.Arg(0); command {
+	case "":
+	case "label":
+		exit(runLabel(pvLabelAdmission, flag.Args()[1:], os.Stdin, os.Stdout, os.Stderr))
+	case "backfill":
+		exit(runBackfill(pvLabelAdmission, flag.Args()[1:], os.Stdout, os.Stderr))
+	case "audit":
+		exit(runAudit(pvLabelAdmission, flag.Args()[1:], os.Stdout, os.Stderr))
+	default:
+		klog.Fatalf("unknown command %q", command)
+	}
+
+	certSource, err := newCertificateSource(context.Background())
+	if err != nil {
+		klog.Fatalf("error loading serving certificate: %v", err)
+	}
+	go certSource.Start(context.Background())
+	metrics.RegisterCertificateExpiry(certSource.NotAfter)
+
+	readyz := health.NewChecker()
+	readyz.AddCheck("tls", func() error {
+		if _, err := certSource.GetCertificate(nil); err != nil {
+			return err
+		}
+		if notAfter := certSource.NotAfter(); time.Now().After(notAfter) {
+			return fmt.Errorf("serving certificate expired at %v", notAfter)
+		}
+		return nil
+	})
+	healthCheckVolumes, err := parseProviderValues("--health-check-volume", splitList(cloudProvider), healthCheckVolume)
+	if err != nil {
+		klog.Fatalf("error configuring cloud provider health check: %v", err)
+	}
+	for provider, volume := range healthCheckVolumes {
+		pv, err := newHealthCheckPV(provider, volume)
+		if err != nil {
+			klog.Fatalf("error configuring cloud provider health check: %v", err)
+		}
+		// The cloud provider itself is checked, not the cache in front of it
+		cloudChecker := health.NewCloudChecker(uncachedLabelers[provider], pv, healthCheckPeriod, 5*time.Second)
+		go cloudChecker.Start(context.Background())
+
+		checkName := "cloud-provider"
+		if len(pvLabelers) > 1 {
+			checkName += "-" + provider
+		}
+		readyz.AddCheck(checkName, cloudChecker.Check)
+	}
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/admit", pvLabelAdmission.Admit)
+	// Only admission requests are traced, not scrapes and probes
+	mux.Handle("/admit", otelhttp.NewHandler(http.HandlerFunc(pvLabelAdmission.Admit), "/admit", otelhttp.WithTracerProvider(tracerProvider)))
+	mux.Handle("/validate", otelhttp.NewHandler(http.HandlerFunc(pvLabelAdmission.Validate), "/validate", otelhttp.WithTracerProvider(tracerProvider)))
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz", health.Ping)
+	mux.Handle("/readyz", readyz)
 	server := &http.Server{
 		Addr:    addr,
 		Handler: mux,
 		TLSConfig: &tls.Config{
-			MinVersion: tls.VersionTLS13,
+			MinVersion:     tls.VersionTLS13,
+			GetCertificate: certSource.GetCertificate,
 		},
 	}
 
+	// Stop serving on SIGTERM so that the deferred functions export the
+	// remaining spans before exiting
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			klog.ErrorS(err, "failed to shut down webhook server")
+		}
+	}()
+
 	klog.Info("Starting webhook server")
-	log.Fatal(server.ListenAndServeTLS(tlsCertPath, tlsKeyPath))
+	if err := server.ListenAndServeTLS("", ""); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-shutdownDone
+	klog.Info("Webhook server stopped")
+}
+
+func isValidNodeAffinityStrategy(strategy admission.NodeAffinityStrategy) bool {
+	for _, s := range admission.NodeAffinityStrategies {
+		if s == strategy {
+			return true
+		}
+	}
+	return false
+}
+
+func isValidLabelPolicy(policy admission.LabelPolicy) bool {
+	for _, p := range admission.LabelPolicies {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+func newCertificateSource(ctx context.Context) (certificateSource, error) {
+	if !selfSignedCerts {
+		return certs.NewWatcher(tlsCertPath, tlsKeyPath, tlsReloadPeriod)
+	}
+
+	client, err := newKubeClient()
+	if err != nil {
+		return nil, err
+	}
+
+	bootstrapper := certs.NewBootstrapper(client, certs.BootstrapConfig{
+		Namespace:             namespace,
+		SecretName:            certSecretName,
+		ServiceName:           serviceName,
+		WebhookName:           webhookName,
+		ValidatingWebhookName: validatingWebhookName,
+		Validity:              selfSignedCertValidity,
+		CheckInterval:         time.Hour,
+	})
+	if err := bootstrapper.EnsureCertificates(ctx); err != nil {
+		return nil, err
+	}
+
+	return bootstrapper, nil
+}
+
+func newKubeClient() (kubernetes.Interface, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("error building kubeconfig: %v", err)
+	}
+
+	return kubernetes.NewForConfig(config)
+}
+
+// newEventRecorder returns an EventRecorder sending events to the API server in
+// the background. Events are dropped rather than delaying admission requests
+// when they cannot be sent fast enough.
+func newEventRecorder(scheme *runtime.Scheme) (record.EventRecorder, error) {
+	client, err := newKubeClient()
+	if err != nil {
+		return nil, err
+	}
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartStructuredLogging(4)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme, corev1.EventSource{Component: "cloud-pv-admission-labeler"}), nil
 }
 
 func newProvider(cloudProviderName, cloudConfigPath string) (cloudprovider.PVLabeler, error) {
@@ -98,3 +409,25 @@ func newProvider(cloudProviderName, cloudConfigPath string) (cloudprovider.PVLab
 
 	return pVLabeler, nil
 }
+
+// newHealthCheckPV returns a PV referring to the given volume of the cloud
+// provider, used to check that the provider can look up volumes.
+func newHealthCheckPV(cloudProviderName, volume string) (*corev1.PersistentVolume, error) {
+	pv := &corev1.PersistentVolume{}
+	pv.Name = "cloud-pv-admission-labeler-health-check"
+
+	switch cloudProviderName {
+	case "gce":
+		pv.Spec.GCEPersistentDisk = &corev1.GCEPersistentDiskVolumeSource{PDName: volume}
+	case "aws":
+		pv.Spec.AWSElasticBlockStore = &corev1.AWSElasticBlockStoreVolumeSource{VolumeID: volume}
+	case "azure":
+		pv.Spec.AzureDisk = &corev1.AzureDiskVolumeSource{DataDiskURI: volume}
+	case "vsphere":
+		pv.Spec.VsphereVolume = &corev1.VsphereVirtualDiskVolumeSource{VolumePath: volume}
+	default:
+		return nil, fmt.Errorf("health checks are not supported for cloud provider %q", cloudProviderName)
+	}
+
+	return pv, nil
+}
@@ -0,0 +1,118 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "cloud_pv_labeler"
+
+// Admission outcomes
+const (
+	// OutcomeLabeled is recorded when a patch adding labels or node affinity is returned.
+	OutcomeLabeled = "labeled"
+	// OutcomeSkipped is recorded when the PV is admitted without changes.
+	OutcomeSkipped = "skipped"
+	// OutcomeAllowed is recorded when a PV passes validation.
+	OutcomeAllowed = "allowed"
+	// OutcomePending is recorded when the PV is admitted without labels because the cloud provider lookup failed.
+	OutcomePending = "pending"
+	// OutcomeRejected is recorded when the PV is denied.
+	OutcomeRejected = "rejected"
+	// OutcomeError is recorded when the request could not be handled.
+	OutcomeError = "error"
+)
+
+// Cache lookup results
+const (
+	// CacheHit is recorded when labels are served from the cache.
+	CacheHit = "hit"
+	// CacheNegativeHit is recorded when a cached lookup error is returned.
+	CacheNegativeHit = "negative_hit"
+	// CacheMiss is recorded when the labels are looked up from the cloud provider.
+	CacheMiss = "miss"
+	// CacheCoalesced is recorded when a lookup shares a concurrent lookup of the same volume.
+	CacheCoalesced = "coalesced"
+)
+
+var (
+	registry = prometheus.NewRegistry()
+
+	admissionTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "admission_requests_total",
+		Help:      "Number of admission requests by provider, volume type, outcome and reason.",
+	}, []string{"provider", "volume_type", "outcome", "reason"})
+
+	admissionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "admission_duration_seconds",
+		Help:      "End-to-end latency of admission requests by provider and outcome.",
+		Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"provider", "outcome"})
+
+	cloudRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "cloud_request_duration_seconds",
+		Help:      "Latency of cloud provider volume label lookups by provider, volume type and result.",
+		Buckets:   []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"provider", "volume_type", "result"})
+
+	cacheRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_requests_total",
+		Help:      "Number of volume label cache lookups by provider and result.",
+	}, []string{"provider", "result"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		admissionTotal,
+		admissionDuration,
+		cloudRequestDuration,
+		cacheRequestsTotal,
+	)
+}
+
+// Handler returns the HTTP handler serving the webhook metrics.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// RecordAdmission records the outcome and latency of an admission request.
+func RecordAdmission(provider, volumeType, outcome, reason string, duration time.Duration) {
+	admissionTotal.WithLabelValues(provider, volumeType, outcome, reason).Inc()
+	admissionDuration.WithLabelValues(provider, outcome).Observe(duration.Seconds())
+}
+
+// RecordCloudRequest records the latency of a cloud provider lookup.
+func RecordCloudRequest(provider, volumeType string, err error, duration time.Duration) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	cloudRequestDuration.WithLabelValues(provider, volumeType, result).Observe(duration.Seconds())
+}
+
+// RecordCacheRequest records the result of a volume label cache lookup.
+func RecordCacheRequest(provider, result string) {
+	cacheRequestsTotal.WithLabelValues(provider, result).Inc()
+}
+
+// RegisterCertificateExpiry exports the expiry date of the serving certificate
+// returned by notAfter as a Unix timestamp.
+func RegisterCertificateExpiry(notAfter func() time.Time) {
+	registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "certificate_expiry_timestamp_seconds",
+		Help:      "Expiry date of the serving certificate as a Unix timestamp.",
+	}, func() float64 {
+		return float64(notAfter().Unix())
+	}))
+}
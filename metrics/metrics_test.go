@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_RecordAdmission(t *testing.T) {
+	RecordAdmission("gce", "gce-pd", OutcomeLabeled, "patched", 10*time.Millisecond)
+	RecordAdmission("gce", "gce-pd", OutcomeLabeled, "patched", 20*time.Millisecond)
+	RecordAdmission("gce", "gce-pd", OutcomeRejected, "cloud_error", 5*time.Millisecond)
+
+	if v := testutil.ToFloat64(admissionTotal.WithLabelValues("gce", "gce-pd", OutcomeLabeled, "patched")); v != 2 {
+		t.Errorf("expected 2 labeled admissions, got %v", v)
+	}
+	if v := testutil.ToFloat64(admissionTotal.WithLabelValues("gce", "gce-pd", OutcomeRejected, "cloud_error")); v != 1 {
+		t.Errorf("expected 1 rejected admission, got %v", v)
+	}
+}
+
+func Test_Handler(t *testing.T) {
+	RecordCloudRequest("aws", "aws-ebs", errors.New("not found"), time.Second)
+	RegisterCertificateExpiry(func() time.Time { return time.Unix(1700000000, 0) })
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := rec.Body.String()
+	for _, expected := range []string{
+		`cloud_pv_labeler_cloud_request_duration_seconds_count{provider="aws",result="error",volume_type="aws-ebs"} 1`,
+		`cloud_pv_labeler_certificate_expiry_timestamp_seconds 1.7e+09`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("metrics output does not contain %q", expected)
+		}
+	}
+}
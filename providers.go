@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/informers"
+	cloudprovider "k8s.io/cloud-provider"
+
+	"sigs.k8s.io/cloud-pv-admission-labeler/admission"
+	"sigs.k8s.io/cloud-pv-admission-labeler/labeler"
+	"sigs.k8s.io/cloud-pv-admission-labeler/labeler/cache"
+	"sigs.k8s.io/cloud-pv-admission-labeler/labeler/external"
+	"sigs.k8s.io/cloud-pv-admission-labeler/labeler/inference"
+	"sigs.k8s.io/cloud-pv-admission-labeler/labeler/static"
+)
+
+// Label sources of --label-sources.
+const (
+	labelSourceCloud     = "cloud"
+	labelSourceSnapshot  = "snapshot"
+	labelSourceStatic    = "static"
+	labelSourceInference = "inference"
+)
+
+var labelSources = []string{labelSourceCloud, labelSourceSnapshot, labelSourceStatic, labelSourceInference}
+
+// newPVLabelers initializes the PVLabelers of the comma-separated cloud
+// providers, indexed by cloud provider name, each with its own cloud config.
+// The PVLabelers are also returned without their cache, for health checks.
+func newPVLabelers(cloudProviders, cloudConfigPaths string) (map[string]cloudprovider.PVLabeler, map[string]cloudprovider.PVLabeler, error) {
+	providers := splitList(cloudProviders)
+	if len(providers) == 0 {
+		return nil, nil, fmt.Errorf("no cloud provider configured")
+	}
+	configPaths, err := parseProviderValues("--cloud-config", providers, cloudConfigPaths)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pvLabelers := make(map[string]cloudprovider.PVLabeler, len(providers))
+	uncachedLabelers := make(map[string]cloudprovider.PVLabeler, len(providers))
+	for _, provider := range providers {
+		if _, ok := pvLabelers[provider]; ok {
+			return nil, nil, fmt.Errorf("cloud provider %q configured more than once", provider)
+		}
+
+		if provider == admission.ExternalProvider {
+			if configPaths[provider] != "" {
+				return nil, nil, fmt.Errorf("the external labeler is configured with the --external-labeler flags, not --cloud-config")
+			}
+			pvLabeler, err := newExternalLabeler()
+			if err != nil {
+				return nil, nil, err
+			}
+			pvLabelers[provider], uncachedLabelers[provider] = pvLabeler, pvLabeler
+			continue
+		}
+		if provider == admission.StaticProvider {
+			pvLabeler, err := newStaticLabeler(configPaths[provider])
+			if err != nil {
+				return nil, nil, err
+			}
+			pvLabelers[provider], uncachedLabelers[provider] = pvLabeler, pvLabeler
+			continue
+		}
+		if provider == admission.InferenceProvider {
+			if configPaths[provider] != "" {
+				return nil, nil, fmt.Errorf("the %s cloud provider has no cloud config", provider)
+			}
+			pvLabeler, err := newInferenceLabeler()
+			if err != nil {
+				return nil, nil, err
+			}
+			pvLabelers[provider], uncachedLabelers[provider] = pvLabeler, pvLabeler
+			continue
+		}
+
+		pvLabeler, err := newProvider(provider, configPaths[provider])
+		if err != nil {
+			return nil, nil, fmt.Errorf("error initializing cloud provider %s: %w", provider, err)
+		}
+		if pvLabeler == nil {
+			return nil, nil, fmt.Errorf("unknown cloud provider %q", provider)
+		}
+		uncachedLabelers[provider] = pvLabeler
+		if cacheTTL > 0 {
+			pvLabeler = cache.New(provider, pvLabeler, cacheTTL, cacheNegativeTTL)
+		}
+		pvLabelers[provider] = pvLabeler
+	}
+
+	return pvLabelers, uncachedLabelers, nil
+}
+
+// chainLabelSources returns a chain of the label sources, in order, for each
+// of the cloud providers. The chains are only used to label PVs: validation,
+// the drift audit and health checks query the cloud providers themselves.
+// Only the cloud providers are chained, the external, static and inference
+// labelers are not cloud APIs that can be degraded. No chains are returned if
+// the cloud providers are the only label source.
+func chainLabelSources(pvLabelers map[string]cloudprovider.PVLabeler, sources []string) (map[string]cloudprovider.PVLabeler, error) {
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no label source configured in --label-sources")
+	}
+	for i, source := range sources {
+		if !contains(labelSources, source) {
+			return nil, fmt.Errorf("invalid label source %q, must be one of %v", source, labelSources)
+		}
+		if contains(sources[:i], source) {
+			return nil, fmt.Errorf("label source %q configured more than once", source)
+		}
+	}
+	if len(sources) == 1 && sources[0] == labelSourceCloud {
+		// The cloud providers are queried directly
+		return nil, nil
+	}
+
+	chains := make(map[string]cloudprovider.PVLabeler)
+	inferenceLabeler := pvLabelers[admission.InferenceProvider]
+	for provider, pvLabeler := range pvLabelers {
+		switch provider {
+		case admission.ExternalProvider, admission.StaticProvider, admission.InferenceProvider:
+			continue
+		}
+
+		chain := make([]labeler.Source, 0, len(sources))
+		for _, source := range sources {
+			var sourceLabeler cloudprovider.PVLabeler
+			switch source {
+			case labelSourceCloud:
+				sourceLabeler = pvLabeler
+			case labelSourceSnapshot:
+				cachingLabeler, ok := pvLabeler.(*cache.Labeler)
+				if !ok {
+					return nil, fmt.Errorf("the %s label source requires --cache-ttl", source)
+				}
+				sourceLabeler = cachingLabeler.Snapshot()
+			case labelSourceStatic:
+				staticLabeler, ok := pvLabelers[admission.StaticProvider]
+				if !ok {
+					return nil, fmt.Errorf("the %s label source requires the %s cloud provider in --cloud-provider", source, admission.StaticProvider)
+				}
+				sourceLabeler = staticLabeler
+			case labelSourceInference:
+				if inferenceLabeler == nil {
+					// Shared by the cloud providers, without labeling the
+					// volumes of other cloud providers
+					var err error
+					if inferenceLabeler, err = newInferenceLabeler(); err != nil {
+						return nil, err
+					}
+				}
+				sourceLabeler = inferenceLabeler
+			}
+			chain = append(chain, labeler.Source{Name: source, Labeler: sourceLabeler, Timeout: labelSourceTimeout})
+		}
+		chains[provider] = labeler.NewChain(chain...)
+	}
+	return chains, nil
+}
+
+// newExternalLabeler returns the PVLabeler calling the external labeler. Its
+// labels are not cached since it may label any volume.
+func newExternalLabeler() (cloudprovider.PVLabeler, error) {
+	if externalLabelerEndpoint == "" {
+		return nil, fmt.Errorf("--external-labeler-endpoint is required with the %s cloud provider", admission.ExternalProvider)
+	}
+	return external.New(externalLabelerEndpoint, external.Config{
+		Timeout: externalLabelerTimeout,
+		CAFile:  externalLabelerCAFile,
+	})
+}
+
+// newStaticLabeler returns the PVLabeler resolving labels from the mapping
+// file, reloaded whenever it changes. Its labels are not cached since they do
+// not come from a cloud API.
+func newStaticLabeler(mappingPath string) (cloudprovider.PVLabeler, error) {
+	if mappingPath == "" {
+		return nil, fmt.Errorf("--cloud-config must be set to a mapping file with the %s cloud provider", admission.StaticProvider)
+	}
+	pvLabeler, err := static.New(mappingPath, staticReloadPeriod)
+	if err != nil {
+		return nil, err
+	}
+	go pvLabeler.Start(context.Background())
+	return pvLabeler, nil
+}
+
+// newInferenceLabeler returns the PVLabeler inferring labels from volume
+// identifiers and the StorageClasses of an informer started in the background.
+func newInferenceLabeler() (cloudprovider.PVLabeler, error) {
+	client, err := newKubeClient()
+	if err != nil {
+		return nil, fmt.Errorf("error creating Kubernetes client for the %s labeler: %w", admission.InferenceProvider, err)
+	}
+
+	informerFactory := informers.NewSharedInformerFactory(client, 0)
+	pvLabeler := inference.New(informerFactory.Storage().V1().StorageClasses().Lister())
+	informerFactory.Start(context.Background().Done())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for informerType, synced := range informerFactory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return nil, fmt.Errorf("timed out waiting for the %v informer of the %s labeler to sync", informerType, admission.InferenceProvider)
+		}
+	}
+	return pvLabeler, nil
+}
+
+// parseProviderValues parses a flag configuring each cloud provider. The flag
+// is either a comma-separated list of provider=value pairs or, with a single
+// cloud provider, only its value.
+func parseProviderValues(flagName string, providers []string, value string) (map[string]string, error) {
+	values := make(map[string]string)
+	if value == "" {
+		return values, nil
+	}
+	if len(providers) == 1 && !strings.Contains(value, "=") {
+		values[providers[0]] = value
+		return values, nil
+	}
+
+	for _, pair := range splitList(value) {
+		provider, providerValue, ok := strings.Cut(pair, "=")
+		if !ok || providerValue == "" {
+			return nil, fmt.Errorf("invalid %s %q, must be a list of provider=value pairs with several cloud providers", flagName, pair)
+		}
+		if !contains(providers, provider) {
+			return nil, fmt.Errorf("invalid %s %q, cloud provider %q is not configured in --cloud-provider", flagName, pair, provider)
+		}
+		values[provider] = providerValue
+	}
+	return values, nil
+}
+
+// splitList splits a comma-separated list, ignoring empty items.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	cloudprovider "k8s.io/cloud-provider"
+
+	"sigs.k8s.io/cloud-pv-admission-labeler/admission"
+	"sigs.k8s.io/cloud-pv-admission-labeler/labeler"
+	"sigs.k8s.io/cloud-pv-admission-labeler/labeler/cache"
+)
+
+func Test_parseProviderValues(t *testing.T) {
+	testcases := []struct {
+		name           string
+		providers      []string
+		value          string
+		expectedValues map[string]string
+		expectErr      bool
+	}{
+		{
+			name:           "empty",
+			providers:      []string{"aws"},
+			expectedValues: map[string]string{},
+		},
+		{
+			name:           "single provider",
+			providers:      []string{"aws"},
+			value:          "/etc/cloud/aws.conf",
+			expectedValues: map[string]string{"aws": "/etc/cloud/aws.conf"},
+		},
+		{
+			name:           "provider pairs",
+			providers:      []string{"aws", "vsphere"},
+			value:          "aws=/etc/cloud/aws.conf, vsphere=/etc/cloud/vsphere.conf",
+			expectedValues: map[string]string{"aws": "/etc/cloud/aws.conf", "vsphere": "/etc/cloud/vsphere.conf"},
+		},
+		{
+			name:           "some providers without value",
+			providers:      []string{"aws", "vsphere"},
+			value:          "vsphere=/etc/cloud/vsphere.conf",
+			expectedValues: map[string]string{"vsphere": "/etc/cloud/vsphere.conf"},
+		},
+		{
+			name:      "value without provider with several providers",
+			providers: []string{"aws", "vsphere"},
+			value:     "/etc/cloud/aws.conf",
+			expectErr: true,
+		},
+		{
+			name:      "unconfigured provider",
+			providers: []string{"aws", "vsphere"},
+			value:     "gce=/etc/cloud/gce.conf",
+			expectErr: true,
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			values, err := parseProviderValues("--cloud-config", testcase.providers, testcase.value)
+			if (err != nil) != testcase.expectErr {
+				t.Fatalf("expected error %v, got %v", testcase.expectErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(values, testcase.expectedValues) {
+				t.Logf("actual values: %v", values)
+				t.Logf("expected values: %v", testcase.expectedValues)
+				t.Error("unexpected values")
+			}
+		})
+	}
+}
+
+func Test_chainLabelSources(t *testing.T) {
+	testcases := []struct {
+		name          string
+		providers     []string
+		cached        bool
+		sources       []string
+		expectChained bool
+		expectErr     bool
+	}{
+		{
+			name:      "cloud only",
+			providers: []string{"aws"},
+			sources:   []string{labelSourceCloud},
+		},
+		{
+			name:          "cloud and snapshot",
+			providers:     []string{"aws"},
+			cached:        true,
+			sources:       []string{labelSourceCloud, labelSourceSnapshot},
+			expectChained: true,
+		},
+		{
+			name:          "cloud and static",
+			providers:     []string{"aws", admission.StaticProvider},
+			sources:       []string{labelSourceCloud, labelSourceStatic},
+			expectChained: true,
+		},
+		{
+			name:          "cloud and inference",
+			providers:     []string{"aws", admission.InferenceProvider},
+			sources:       []string{labelSourceCloud, labelSourceInference},
+			expectChained: true,
+		},
+		{
+			name:      "snapshot without cache",
+			providers: []string{"aws"},
+			sources:   []string{labelSourceCloud, labelSourceSnapshot},
+			expectErr: true,
+		},
+		{
+			name:      "static without static cloud provider",
+			providers: []string{"aws"},
+			sources:   []string{labelSourceCloud, labelSourceStatic},
+			expectErr: true,
+		},
+		{
+			name:      "unknown source",
+			providers: []string{"aws"},
+			sources:   []string{labelSourceCloud, "storage"},
+			expectErr: true,
+		},
+		{
+			name:      "duplicate source",
+			providers: []string{"aws"},
+			sources:   []string{labelSourceCloud, labelSourceCloud},
+			expectErr: true,
+		},
+		{
+			name:      "no source",
+			providers: []string{"aws"},
+			expectErr: true,
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			pvLabelers := make(map[string]cloudprovider.PVLabeler)
+			for _, provider := range testcase.providers {
+				var pvLabeler cloudprovider.PVLabeler = &fakePVLabeler{}
+				if testcase.cached {
+					pvLabeler = cache.New(provider, pvLabeler, time.Minute, 0)
+				}
+				pvLabelers[provider] = pvLabeler
+			}
+
+			chains, err := chainLabelSources(pvLabelers, testcase.sources)
+			if (err != nil) != testcase.expectErr {
+				t.Fatalf("expected error %v, got %v", testcase.expectErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if _, chained := chains["aws"].(*labeler.Chain); chained != testcase.expectChained {
+				t.Errorf("expected chained %v, got %v", testcase.expectChained, chained)
+			}
+			for _, provider := range []string{admission.StaticProvider, admission.InferenceProvider} {
+				if _, ok := chains[provider]; ok {
+					t.Errorf("unexpected chained %s labeler", provider)
+				}
+			}
+			// The cloud providers are still queried directly outside of labeling
+			for provider, pvLabeler := range pvLabelers {
+				if _, chained := pvLabeler.(*labeler.Chain); chained {
+					t.Errorf("%s labeler was replaced by its chain", provider)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracingShutdownTimeout bounds how long the remaining spans are exported for
+// on exit.
+const tracingShutdownTimeout = 5 * time.Second
+
+// newTracerProvider returns the TracerProvider exporting spans to the OTLP
+// collector at --tracing-endpoint, sampled at --tracing-sampling-ratio, and
+// the function shutting it down, which exports the spans it still holds.
+// Tracing is disabled if the endpoint is empty.
+func newTracerProvider(ctx context.Context) (trace.TracerProvider, func(context.Context) error, error) {
+	if tracingEndpoint == "" {
+		return trace.NewNoopTracerProvider(), func(context.Context) error { return nil }, nil
+	}
+	if tracingSamplingRatio < 0 || tracingSamplingRatio > 1 {
+		return nil, nil, fmt.Errorf("invalid --tracing-sampling-ratio %v, must be between 0 and 1", tracingSamplingRatio)
+	}
+
+	options := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(tracingEndpoint)}
+	if tracingInsecure {
+		options = append(options, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(ctx, options...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating OTLP trace exporter: %v", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(tracingServiceName)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating tracing resource: %v", err)
+	}
+
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		// Follow the sampling decision of the API server when it traces the
+		// webhook call
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(tracingSamplingRatio))),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return tracerProvider, tracerProvider.Shutdown, nil
+}